@@ -0,0 +1,261 @@
+// tsadmin/alert
+package alert
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/config"
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+// The states an alert goes through
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// How long resolved alerts are still shown for
+const resolvedRetention = 5 * time.Minute
+
+// Alert is a rule that is, or recently was, matching a database
+type Alert struct {
+	Rule        string     `json:"rule"`
+	Database    string     `json:"database"`
+	Group       string     `json:"group"`
+	Severity    string     `json:"severity"`
+	Description string     `json:"description"`
+	Expr        string     `json:"expr"`
+	State       string     `json:"state"`
+	Value       float64    `json:"value"`
+	ActiveSince time.Time  `json:"active_since"`
+	FiredAt     *time.Time `json:"fired_at"`
+	ResolvedAt  *time.Time `json:"resolved_at"`
+}
+
+// Transition is an alert changing state, these are what get notified about
+type Transition struct {
+	Alert Alert  `json:"alert"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// Engine evaluates the alert rules against each set of statuses and keeps track
+// of the state of every alert
+type Engine struct {
+	mutex       sync.RWMutex
+	alerts      map[string]*Alert
+	expressions map[string]*Expression
+	invalid     map[string]bool
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		alerts:      make(map[string]*Alert),
+		expressions: make(map[string]*Expression),
+		invalid:     make(map[string]bool),
+	}
+}
+
+// Evaluate the rules against the latest statuses, returning any alerts that changed state
+func (e *Engine) Evaluate(rules []config.AlertRule, statuses []*database.DatabaseStatus, now time.Time) []Transition {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	transitions := []Transition{}
+	seen := make(map[string]bool)
+	silenced := make(map[string]bool)
+
+	// Databases under maintenance aren't alerted on at all
+	for _, status := range statuses {
+		silenced[status.Metadata.Name] = status.Maintenance
+	}
+
+	for _, rule := range rules {
+		expr := e.compile(rule.Expr)
+
+		// The resolve expression is optional, without it we resolve when expr is false
+		var resolve *Expression
+
+		if rule.Resolve != "" {
+			resolve = e.compile(rule.Resolve)
+		}
+
+		if expr == nil || (rule.Resolve != "" && resolve == nil) {
+			continue
+		}
+
+		for _, status := range statuses {
+			if silenced[status.Metadata.Name] || !applies(rule, status) {
+				continue
+			}
+
+			key := rule.Name + "/" + status.Metadata.Name
+			values := status.Values()
+			seen[key] = true
+
+			if transition := e.update(key, rule, expr, resolve, status, values, now); transition != nil {
+				transitions = append(transitions, *transition)
+			}
+		}
+	}
+
+	for key, alert := range e.alerts {
+		if seen[key] {
+			continue
+		}
+
+		// The rule or the database has gone away, or the database is under
+		// maintenance, so the alert is over. Anyone who heard it was firing
+		// needs to hear that too.
+		if alert.State == StateFiring {
+			transitions = append(transitions, e.transition(alert, StateResolved, now))
+		} else if alert.State == StatePending {
+			delete(e.alerts, key)
+		}
+	}
+
+	// Forget about alerts that resolved a while ago
+	for key, alert := range e.alerts {
+		if alert.State == StateResolved && now.Sub(*alert.ResolvedAt) > resolvedRetention {
+			delete(e.alerts, key)
+		}
+	}
+
+	return transitions
+}
+
+// Move an alert on to its next state if it needs to
+func (e *Engine) update(key string, rule config.AlertRule, expr *Expression, resolve *Expression, status *database.DatabaseStatus, values map[string]float64, now time.Time) *Transition {
+	alert, ok := e.alerts[key]
+	matches := expr.Match(values)
+
+	// Nothing to see here
+	if (!ok || alert.State == StateResolved) && !matches {
+		return nil
+	}
+
+	// A new alert
+	if !ok || alert.State == StateResolved {
+		alert = &Alert{
+			Rule:        rule.Name,
+			Database:    status.Metadata.Name,
+			Group:       status.Metadata.Group,
+			Severity:    rule.Severity,
+			Description: rule.Description,
+			Expr:        rule.Expr,
+			State:       StatePending,
+			ActiveSince: now,
+		}
+
+		e.alerts[key] = alert
+	}
+
+	alert.Value = expr.Value(values)
+
+	switch alert.State {
+	case StatePending:
+		// It went away before it fired
+		if !matches {
+			delete(e.alerts, key)
+			return nil
+		}
+
+		if now.Sub(alert.ActiveSince) >= rule.For.Duration {
+			transition := e.transition(alert, StateFiring, now)
+			return &transition
+		}
+	case StateFiring:
+		resolved := !matches
+
+		if resolve != nil {
+			resolved = resolve.Match(values)
+		}
+
+		if resolved {
+			transition := e.transition(alert, StateResolved, now)
+			return &transition
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) transition(alert *Alert, to string, now time.Time) Transition {
+	from := alert.State
+	alert.State = to
+
+	if to == StateFiring {
+		alert.FiredAt = &now
+	} else if to == StateResolved {
+		alert.ResolvedAt = &now
+	}
+
+	return Transition{Alert: *alert, From: from, To: to}
+}
+
+// Parse the expression, caching it so we only parse each one once. Invalid
+// expressions are logged the first time we see them and then ignored.
+func (e *Engine) compile(source string) *Expression {
+	if expr, ok := e.expressions[source]; ok {
+		return expr
+	}
+
+	expr, err := Parse(source)
+
+	if err != nil {
+		if !e.invalid[source] {
+			log.Printf("Invalid alert expression %q: %s", source, err)
+			e.invalid[source] = true
+		}
+
+		return nil
+	}
+
+	e.expressions[source] = expr
+
+	return expr
+}
+
+// Whether the rule applies to the given database
+func applies(rule config.AlertRule, status *database.DatabaseStatus) bool {
+	if !config.Matches(rule.Groups, status.Metadata.Group) {
+		return false
+	}
+
+	if !config.Matches(rule.Databases, status.Metadata.Name) {
+		return false
+	}
+
+	return true
+}
+
+// All the current alerts, firing first then pending then resolved
+func (e *Engine) Alerts() []Alert {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	order := map[string]int{StateFiring: 0, StatePending: 1, StateResolved: 2}
+	alerts := []Alert{}
+
+	for _, alert := range e.alerts {
+		alerts = append(alerts, *alert)
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].State != alerts[j].State {
+			return order[alerts[i].State] < order[alerts[j].State]
+		}
+
+		if alerts[i].Database != alerts[j].Database {
+			return alerts[i].Database < alerts[j].Database
+		}
+
+		return alerts[i].Rule < alerts[j].Rule
+	})
+
+	return alerts
+}
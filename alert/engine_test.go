@@ -0,0 +1,141 @@
+// tsadmin/alert
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/config"
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+func connections(current int) []*database.DatabaseStatus {
+	status := &database.DatabaseStatus{
+		Metadata: database.DatabaseMetadata{Name: "db1", Group: "demo"},
+		State:    database.StateOK,
+	}
+
+	status.Metrics.CurrentConnections = current
+	status.Variables.MaxConnections = 100
+
+	return []*database.DatabaseStatus{status}
+}
+
+func TestEvaluate(t *testing.T) {
+	rule := config.AlertRule{
+		Name:    "connections",
+		Expr:    "current_connections / max_connections > 0.9",
+		Resolve: "current_connections / max_connections < 0.8",
+		For:     config.Duration{Duration: time.Minute},
+	}
+
+	start := time.Now()
+
+	steps := []struct {
+		after       time.Duration
+		connections int
+		transition  string
+		state       string
+	}{
+		// Pending until it has matched for a minute
+		{0, 95, "", StatePending},
+		{30 * time.Second, 95, "", StatePending},
+		{time.Minute, 95, StatePending + ">" + StateFiring, StateFiring},
+		// Still firing between the two thresholds
+		{2 * time.Minute, 85, "", StateFiring},
+		{3 * time.Minute, 75, StateFiring + ">" + StateResolved, StateResolved},
+		// Starts again from pending, and going away before for is up is quiet
+		{4 * time.Minute, 95, "", StatePending},
+		{4*time.Minute + 30*time.Second, 50, "", ""},
+	}
+
+	engine := NewEngine()
+
+	for i, step := range steps {
+		transitions := engine.Evaluate([]config.AlertRule{rule}, connections(step.connections), start.Add(step.after))
+		transition := ""
+
+		if len(transitions) > 1 {
+			t.Fatalf("step %d: got %d transitions", i, len(transitions))
+		}
+
+		if len(transitions) == 1 {
+			transition = transitions[0].From + ">" + transitions[0].To
+		}
+
+		if transition != step.transition {
+			t.Errorf("step %d: got transition %q, want %q", i, transition, step.transition)
+		}
+
+		state := ""
+
+		if alerts := engine.Alerts(); len(alerts) > 0 {
+			state = alerts[0].State
+		}
+
+		if state != step.state {
+			t.Errorf("step %d: alert is %q, want %q", i, state, step.state)
+		}
+	}
+}
+
+func TestEvaluateWithoutResolve(t *testing.T) {
+	rule := config.AlertRule{Name: "connections", Expr: "current_connections > 90"}
+	engine := NewEngine()
+	now := time.Now()
+
+	// Without for it fires straight away, and resolves as soon as expr is false
+	if transitions := engine.Evaluate([]config.AlertRule{rule}, connections(95), now); len(transitions) != 1 || transitions[0].To != StateFiring {
+		t.Fatalf("got %+v, want the alert to fire", transitions)
+	}
+
+	if transitions := engine.Evaluate([]config.AlertRule{rule}, connections(85), now.Add(time.Second)); len(transitions) != 1 || transitions[0].To != StateResolved {
+		t.Fatalf("got %+v, want the alert to resolve", transitions)
+	}
+}
+
+func TestEvaluateMaintenance(t *testing.T) {
+	rule := config.AlertRule{Name: "connections", Expr: "current_connections > 90"}
+	engine := NewEngine()
+	now := time.Now()
+
+	engine.Evaluate([]config.AlertRule{rule}, connections(95), now)
+
+	// Firing alerts resolve once maintenance starts
+	statuses := connections(95)
+	statuses[0].Maintenance = true
+
+	if transitions := engine.Evaluate([]config.AlertRule{rule}, statuses, now.Add(time.Second)); len(transitions) != 1 || transitions[0].To != StateResolved {
+		t.Errorf("got %+v when maintenance started, want the alert to resolve", transitions)
+	}
+
+	// And nothing else happens until it's over
+	if transitions := engine.Evaluate([]config.AlertRule{rule}, statuses, now.Add(2*time.Second)); len(transitions) != 0 {
+		t.Errorf("got %+v during maintenance, want nothing", transitions)
+	}
+
+	if alerts := engine.Alerts(); len(alerts) != 1 || alerts[0].State != StateResolved {
+		t.Errorf("got %+v during maintenance, want the resolved alert", alerts)
+	}
+
+	// Pending alerts are just dropped
+	engine = NewEngine()
+	engine.Evaluate([]config.AlertRule{{Name: "connections", Expr: "current_connections > 90", For: config.Duration{Duration: time.Minute}}}, connections(95), now)
+
+	if transitions := engine.Evaluate([]config.AlertRule{rule}, statuses, now.Add(time.Second)); len(transitions) != 0 || len(engine.Alerts()) != 0 {
+		t.Errorf("got %+v for a pending alert during maintenance, want nothing", transitions)
+	}
+}
+
+func TestEvaluateRemovedRule(t *testing.T) {
+	rule := config.AlertRule{Name: "connections", Expr: "current_connections > 90"}
+	engine := NewEngine()
+	now := time.Now()
+
+	engine.Evaluate([]config.AlertRule{rule}, connections(95), now)
+
+	// The rule going away resolves what it set off
+	if transitions := engine.Evaluate(nil, connections(95), now.Add(time.Second)); len(transitions) != 1 || transitions[0].To != StateResolved {
+		t.Errorf("got %+v, want the alert to resolve", transitions)
+	}
+}
@@ -0,0 +1,338 @@
+// tsadmin/alert
+package alert
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+// Expression is a parsed alert condition such as "current_connections / max_connections > 0.9",
+// it supports numbers, metric names, + - * / and brackets, comparisons and and/or. Durations
+// such as 30s or 1h30m are numbers of seconds, so "seconds_behind_master > 5m" works.
+type Expression struct {
+	source string
+	root   node
+}
+
+type node interface {
+	eval(values map[string]float64) float64
+}
+
+type number float64
+
+type metric string
+
+type unary struct {
+	op      string
+	operand node
+}
+
+type binary struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n number) eval(values map[string]float64) float64 {
+	return float64(n)
+}
+
+// Unknown metrics are NaN which makes any comparison using them false
+func (m metric) eval(values map[string]float64) float64 {
+	if value, ok := values[string(m)]; ok {
+		return value
+	}
+
+	return math.NaN()
+}
+
+func (u unary) eval(values map[string]float64) float64 {
+	value := u.operand.eval(values)
+
+	if u.op == "not" {
+		return truth(value == 0 && !math.IsNaN(value))
+	}
+
+	return -value
+}
+
+func (b binary) eval(values map[string]float64) float64 {
+	left := b.left.eval(values)
+	right := b.right.eval(values)
+
+	switch b.op {
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	case "/":
+		if right == 0 {
+			return math.NaN()
+		}
+
+		return left / right
+	case ">":
+		return truth(left > right)
+	case ">=":
+		return truth(left >= right)
+	case "<":
+		return truth(left < right)
+	case "<=":
+		return truth(left <= right)
+	case "==":
+		return truth(left == right)
+	case "!=":
+		return truth(left != right && !math.IsNaN(left) && !math.IsNaN(right))
+	case "and":
+		return truth(isTrue(left) && isTrue(right))
+	case "or":
+		return truth(isTrue(left) || isTrue(right))
+	}
+
+	return math.NaN()
+}
+
+func truth(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+func isTrue(value float64) bool {
+	return value != 0 && !math.IsNaN(value)
+}
+
+// Parse an alert condition
+func Parse(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.position < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.tokens[p.position], source)
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// Whether the condition holds for the given values
+func (e *Expression) Match(values map[string]float64) bool {
+	return isTrue(e.root.eval(values))
+}
+
+// The value being tested, for "a / b > 0.9" this is the value of a / b
+func (e *Expression) Value(values map[string]float64) float64 {
+	if b, ok := e.root.(binary); ok && isComparison(b.op) {
+		return b.left.eval(values)
+	}
+
+	return e.root.eval(values)
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+		return true
+	}
+
+	return false
+}
+
+// Split the source into numbers, names, operators and brackets. Numbers can have
+// a unit straight after them to make them a duration.
+func tokenize(source string) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || unicode.IsLetter(runes[i])) {
+				i++
+			}
+
+			tokens = append(tokens, string(runes[start:i]))
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+
+			tokens = append(tokens, strings.ToLower(string(runes[start:i])))
+		case strings.ContainsRune("<>=!", r) && i+1 < len(runes) && runes[i+1] == '=':
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		case strings.ContainsRune("<>+-*/()", r):
+			tokens = append(tokens, string(r))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", r, source)
+		}
+	}
+
+	return tokens, nil
+}
+
+// A recursive descent parser, from loosest to tightest binding:
+// or, and, not, comparisons, + and -, * and /, unary minus
+type parser struct {
+	tokens   []string
+	position int
+}
+
+func (p *parser) peek() string {
+	if p.position < len(p.tokens) {
+		return p.tokens[p.position]
+	}
+
+	return ""
+}
+
+func (p *parser) next() string {
+	token := p.peek()
+	p.position++
+
+	return token
+}
+
+func (p *parser) or() (node, error) {
+	return p.binary(p.and, "or")
+}
+
+func (p *parser) and() (node, error) {
+	return p.binary(p.not, "and")
+}
+
+func (p *parser) not() (node, error) {
+	if p.peek() == "not" {
+		p.next()
+		operand, err := p.not()
+
+		return unary{op: "not", operand: operand}, err
+	}
+
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.sum()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if isComparison(p.peek()) {
+		op := p.next()
+		right, err := p.sum()
+
+		return binary{op: op, left: left, right: right}, err
+	}
+
+	return left, nil
+}
+
+func (p *parser) sum() (node, error) {
+	return p.binary(p.product, "+", "-")
+}
+
+func (p *parser) product() (node, error) {
+	return p.binary(p.negation, "*", "/")
+}
+
+func (p *parser) negation() (node, error) {
+	if p.peek() == "-" {
+		p.next()
+		operand, err := p.negation()
+
+		return unary{op: "-", operand: operand}, err
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	token := p.next()
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		inner, err := p.or()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+
+		return inner, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		if value, err := strconv.ParseFloat(token, 64); err == nil {
+			return number(value), nil
+		}
+
+		if duration, err := time.ParseDuration(token); err == nil {
+			return number(duration.Seconds()), nil
+		}
+
+		return nil, fmt.Errorf("invalid number %q", token)
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		return metric(token), nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+// Parse a chain of operators that bind equally tightly, left to right
+func (p *parser) binary(operand func() (node, error), ops ...string) (node, error) {
+	left, err := operand()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for config.Contains(ops, p.peek()) {
+		op := p.next()
+		right, err := operand()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = binary{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
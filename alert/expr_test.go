@@ -0,0 +1,100 @@
+// tsadmin/alert
+package alert
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	values := map[string]float64{
+		"current_connections":   90,
+		"max_connections":       100,
+		"seconds_behind_master": 45,
+		"io_running":            1,
+		"sql_running":           0,
+		"zero":                  0,
+	}
+
+	tests := []struct {
+		expr  string
+		match bool
+		value float64
+	}{
+		// Arithmetic and precedence
+		{"1 + 2 * 3 == 7", true, 7},
+		{"(1 + 2) * 3 == 9", true, 9},
+		{"10 - 4 - 3 == 3", true, 3},
+		{"12 / 3 / 2 == 2", true, 2},
+		{"-2 * -3 == 6", true, 6},
+		{"current_connections / max_connections > 0.8", true, 0.9},
+		{"current_connections / max_connections >= 0.95", false, 0.9},
+		{"1e2 == 100", true, 100},
+		{".5 < 1", true, 0.5},
+
+		// and binds tighter than or, not tighter than both
+		{"1 == 1 or 1 == 2 and 1 == 2", true, 1},
+		{"(1 == 1 or 1 == 2) and 1 == 2", false, 0},
+		{"not 1 == 2", true, 1},
+		{"not 1 == 1 or 1 == 1", true, 1},
+		{"not not io_running", true, 1},
+		{"not sql_running", true, 1},
+		{"io_running and not sql_running", true, 1},
+		{"IO_RUNNING AND SQL_RUNNING", false, 0},
+
+		// Durations are seconds
+		{"seconds_behind_master > 30s", true, 45},
+		{"seconds_behind_master > 1m", false, 45},
+		{"seconds_behind_master < 1h30m", true, 45},
+		{"seconds_behind_master > 500ms", true, 45},
+
+		// Unknown metrics and dividing by zero are NaN which never match
+		{"missing > 0", false, math.NaN()},
+		{"missing <= 0", false, math.NaN()},
+		{"missing == missing", false, math.NaN()},
+		{"missing != 1", false, math.NaN()},
+		{"not missing", false, 0},
+		{"missing or io_running", true, 1},
+		{"1 / zero > 0", false, math.NaN()},
+		{"1 / zero != 0", false, math.NaN()},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.expr)
+
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %s", test.expr, err)
+			continue
+		}
+
+		if match := expr.Match(values); match != test.match {
+			t.Errorf("%q matched %t, want %t", test.expr, match, test.match)
+		}
+
+		// The value is the left of a comparison, or the result of anything else
+		value := expr.Value(values)
+
+		if math.IsNaN(test.value) != math.IsNaN(value) || (!math.IsNaN(value) && math.Abs(value-test.value) > 1e-9) {
+			t.Errorf("%q had the value %v, want %v", test.expr, value, test.value)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, source := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"a > > 1",
+		"replication lag > 30",
+		"a > 30x",
+		"a > 1.2.3",
+		"a % 2",
+		"a = 1",
+	} {
+		if _, err := Parse(source); err == nil {
+			t.Errorf("Parse(%q) should have failed", source)
+		}
+	}
+}
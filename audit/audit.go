@@ -0,0 +1,137 @@
+// tsadmin/audit
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The results an action can have
+const (
+	ResultOK      = "ok"
+	ResultRefused = "refused"
+	ResultFailed  = "failed"
+)
+
+// Entry records somebody doing something to a database
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	RemoteAddr string    `json:"remote_addr"`
+	Action     string    `json:"action"`
+	Database   string    `json:"database"`
+	Group      string    `json:"group"`
+	Thread     int64     `json:"thread,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Query      string    `json:"query,omitempty"`
+	QueryHash  string    `json:"query_hash,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Log appends entries to a file with one JSON entry per line, it's never rewritten
+// so the file can be shipped off elsewhere or rotated with copytruncate
+type Log struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func Open(path string) (*Log, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure we can write to it now rather than finding out when someone kills a query
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{path: path}, file.Close()
+}
+
+// Record an entry, filling in the time if it isn't set
+func (l *Log) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Entries returns the most recent entries that match, newest first
+func (l *Log) Entries(limit int, match func(Entry) bool) ([]Entry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries := []Entry{}
+	file, err := os.Open(l.path)
+
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var entry Entry
+
+		// Skip anything that has been mangled rather than losing the whole log
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		if match == nil || match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries, nil
+}
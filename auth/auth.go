@@ -0,0 +1,310 @@
+// tsadmin/auth
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+// The ways someone can prove who they are
+const (
+	MethodBasic   = "basic"
+	MethodToken   = "token"
+	MethodSession = "session"
+)
+
+// Paths anyone can get at, the login page needs its styles and scripts
+var public = []string{"/login", "/login.html", "/health", "/css/", "/js/"}
+
+type contextKey struct{}
+
+// Identity is who made a request and how they proved it
+type Identity struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+}
+
+// Provider checks the credentials of a request, returning nil if it doesn't
+// recognise them
+type Provider interface {
+	Authenticate(r *http.Request, settings config.AuthConfig) *Identity
+}
+
+// Auth is negroni middleware that turns away requests without valid credentials.
+// It's only enabled when there is a users file or some API tokens in the config.
+type Auth struct {
+	settings  func() config.AuthConfig
+	providers []Provider
+	users     *users
+	sessions  *sessions
+	throttle  *throttle
+	verified  *verified
+}
+
+func New(settings func() config.AuthConfig) *Auth {
+	a := &Auth{
+		settings: settings,
+		users:    &users{},
+		sessions: newSessions(),
+		throttle: newThrottle(),
+		verified: newVerified(),
+	}
+
+	a.providers = []Provider{
+		&sessionProvider{a},
+		&basicProvider{a},
+		&tokenProvider{},
+	}
+
+	return a
+}
+
+func (a *Auth) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	settings := a.settings()
+
+	// Auth is turned off
+	if !enabled(settings) {
+		next(w, r)
+		return
+	}
+
+	for _, provider := range a.providers {
+		if identity := provider.Authenticate(r, settings); identity != nil {
+			next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, identity)))
+			return
+		}
+	}
+
+	if isPublic(r.URL.Path) {
+		next(w, r)
+		return
+	}
+
+	// Scripts using basic auth need to hear that they should slow down
+	if username, _, ok := r.BasicAuth(); ok {
+		if wait := a.throttle.wait(time.Now(), loginKeys(settings, r, username)...); wait > 0 {
+			tooManyLogins(w, wait)
+			return
+		}
+	}
+
+	// Send people to the login page and tell everything else what went wrong
+	if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login.html", http.StatusFound)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="tsadmin"`)
+	jsonError(w, http.StatusUnauthorized, "authentication required")
+}
+
+// FromRequest returns who made the request, or nil if auth is off or the path is public
+func FromRequest(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(contextKey{}).(*Identity)
+
+	return identity
+}
+
+// Login checks a username and password, posted as JSON or a form, and starts a session
+func (a *Auth) Login(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid login: %s", err))
+			return
+		}
+	} else {
+		credentials.Username = r.PostFormValue("username")
+		credentials.Password = r.PostFormValue("password")
+	}
+
+	settings := a.settings()
+
+	ok, wait := a.checkPassword(settings, r, credentials.Username, credentials.Password)
+
+	if wait > 0 {
+		tooManyLogins(w, wait)
+		return
+	}
+
+	if !ok {
+		log.Printf("Failed login for %s from %s", credentials.Username, clientAddress(r, settings.TrustedProxies))
+		jsonError(w, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	identity := &Identity{Name: credentials.Username, Method: MethodSession}
+	id, err := a.sessions.start(identity, settings.SessionTTL.Duration)
+
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(settings.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// JSON please
+	w.Header().Set("Content-Type", "application/json")
+
+	jsonResponse, _ := json.Marshal(identity)
+
+	fmt.Fprint(w, string(jsonResponse))
+}
+
+// Logout ends the session of the request, if it has one
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		a.sessions.end(cookie.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Whether the user exists in the users file with the given password. After a few
+// failures from an address, or for a username from that address, they have to wait
+// a while before trying again, if so this returns how long for without checking
+// the password. Failures are only counted against the username together with the
+// address so nobody else can lock a user out.
+func (a *Auth) checkPassword(settings config.AuthConfig, r *http.Request, username string, password string) (bool, time.Duration) {
+	if settings.UsersFile == "" || username == "" {
+		return false, 0
+	}
+
+	now := time.Now()
+	keys := loginKeys(settings, r, username)
+
+	if wait := a.throttle.wait(now, keys...); wait > 0 {
+		return false, wait
+	}
+
+	hash, found, err := a.users.lookup(settings.UsersFile, username)
+
+	if err != nil {
+		log.Printf("Error reading users file: %s", err)
+		return false, 0
+	}
+
+	// Basic auth sends the password with every request, hashing it each time
+	// would be a lot of work for the dashboard's polling
+	if found && a.verified.check(now, username, password, hash) {
+		return true, 0
+	}
+
+	// Unknown users take just as long as known ones
+	if !found {
+		hash = dummyHash
+	}
+
+	if !CheckPassword(password, hash) || !found {
+		a.throttle.failed(now, keys...)
+		return false, 0
+	}
+
+	a.throttle.succeeded(keys[1])
+	a.verified.add(now, username, password, hash)
+
+	return true, 0
+}
+
+// What failed logins are counted against, the address on its own slows down
+// guessing lots of usernames and the username from the address guessing one
+func loginKeys(settings config.AuthConfig, r *http.Request, username string) []string {
+	address := clientAddress(r, settings.TrustedProxies)
+
+	return []string{"address:" + address, "user:" + username + "@" + address}
+}
+
+func tooManyLogins(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Seconds()) + 1
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	jsonError(w, http.StatusTooManyRequests, fmt.Sprintf("too many failed logins, try again in %ds", seconds))
+}
+
+// Usernames and passwords sent with HTTP basic auth
+type basicProvider struct {
+	auth *Auth
+}
+
+func (p *basicProvider) Authenticate(r *http.Request, settings config.AuthConfig) *Identity {
+	username, password, ok := r.BasicAuth()
+
+	if !ok {
+		return nil
+	}
+
+	if ok, _ := p.auth.checkPassword(settings, r, username, password); !ok {
+		return nil
+	}
+
+	return &Identity{Name: username, Method: MethodBasic}
+}
+
+// API tokens sent as Authorization: Bearer <token>
+type tokenProvider struct{}
+
+func (p *tokenProvider) Authenticate(r *http.Request, settings config.AuthConfig) *Identity {
+	header := r.Header.Get("Authorization")
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+
+	hash := HashToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+
+	for _, token := range settings.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(token.Hash))) == 1 {
+			return &Identity{Name: token.Name, Method: MethodToken}
+		}
+	}
+
+	return nil
+}
+
+func isPublic(path string) bool {
+	for _, prefix := range public {
+		if path == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func jsonError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	jsonResponse, _ := json.Marshal(map[string]string{"error": message})
+
+	fmt.Fprint(w, string(jsonResponse))
+}
@@ -0,0 +1,147 @@
+// tsadmin/auth
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+func withUsers(t *testing.T) (*Auth, config.AuthConfig) {
+	hash, err := HashPassword("right")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tsadmin-auth")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "users")
+
+	if err := ioutil.WriteFile(path, []byte("jw:"+hash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := config.AuthConfig{UsersFile: path, TrustedProxies: []string{"10.0.0.0/8"}}
+
+	return New(func() config.AuthConfig { return settings }), settings
+}
+
+func from(address string) *http.Request {
+	r := httptest.NewRequest("GET", "/status.json", nil)
+	r.RemoteAddr = address + ":1234"
+
+	return r
+}
+
+func TestCheckPasswordLockout(t *testing.T) {
+	a, settings := withUsers(t)
+
+	for i := 0; i < freeLoginFailures; i++ {
+		a.checkPassword(settings, from("192.0.2.1"), "jw", "wrong")
+	}
+
+	// The address guessing has to wait
+	if ok, wait := a.checkPassword(settings, from("192.0.2.1"), "jw", "right"); ok || wait == 0 {
+		t.Errorf("got %t after %s from the guessing address, want to wait", ok, wait)
+	}
+
+	// Everyone else can still log in as the user
+	if ok, wait := a.checkPassword(settings, from("192.0.2.2"), "jw", "right"); !ok || wait != 0 {
+		t.Errorf("got %t after %s from another address, want to log in", ok, wait)
+	}
+}
+
+func TestCheckPasswordVerified(t *testing.T) {
+	a, settings := withUsers(t)
+
+	if ok, _ := a.checkPassword(settings, from("192.0.2.1"), "jw", "right"); !ok {
+		t.Fatal("the right password didn't work")
+	}
+
+	hash, _, _ := a.users.lookup(settings.UsersFile, "jw")
+
+	if !a.verified.check(time.Now(), "jw", "right", hash) {
+		t.Error("the password wasn't remembered")
+	}
+
+	if a.verified.check(time.Now(), "jw", "wrong", hash) || a.verified.check(time.Now(), "jw", "right", "changed") {
+		t.Error("a different password or hash was remembered")
+	}
+
+	if a.verified.check(time.Now().Add(verifiedFor), "jw", "right", hash) {
+		t.Error("the password was remembered for too long")
+	}
+}
+
+func TestBasicAuthThrottled(t *testing.T) {
+	a, _ := withUsers(t)
+
+	serve := func(password string) *httptest.ResponseRecorder {
+		r := from("192.0.2.1")
+		r.SetBasicAuth("jw", password)
+		w := httptest.NewRecorder()
+
+		a.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {})
+
+		return w
+	}
+
+	for i := 0; i < freeLoginFailures-1; i++ {
+		if w := serve("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("got %d for a wrong password, want 401", w.Code)
+		}
+	}
+
+	if w := serve("wrong"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d after %d wrong passwords, want 429 with Retry-After", w.Code, freeLoginFailures)
+	}
+
+	if w := serve("right"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d while throttled, want 429", w.Code)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	proxies := []string{"10.0.0.0/8", "192.0.2.10"}
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		address   string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// Only trusted proxies get to say who the client is
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		// The client can put anything it likes at the start
+		{"10.1.2.3:1234", "203.0.113.9, 198.51.100.1, 192.0.2.10", "198.51.100.1"},
+		// Everything was a proxy so the furthest one is as good as we get
+		{"10.1.2.3:1234", "10.0.0.1", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if address := clientAddress(r, proxies); address != test.address {
+			t.Errorf("%s forwarding %q: got %s, want %s", test.remote, test.forwarded, address, test.address)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// tsadmin/auth
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// How passwords are hashed, hashes look like pbkdf2-sha256$100000$<salt>$<key>
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 100000
+	saltLength     = 16
+	keyLength      = 32
+	tokenLength    = 32
+)
+
+// Checked against when a user doesn't exist so that takes as long as getting the
+// password wrong, otherwise how long a login takes gives away who has an account
+var dummyHash = fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations, encode(make([]byte, saltLength)), encode(make([]byte, keyLength)))
+
+// HashPassword hashes a password for the users file
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2([]byte(password), salt, hashIterations, keyLength)
+
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations, encode(salt), encode(key)), nil
+}
+
+// CheckPassword reports whether the password matches the hash
+func CheckPassword(password string, hash string) bool {
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+
+	if err != nil || iterations <= 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	key := pbkdf2([]byte(password), salt, iterations, len(expected))
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// GenerateToken creates a new API token, returning it along with the hash that goes in the config
+func GenerateToken() (string, string, error) {
+	token := make([]byte, tokenLength)
+
+	if _, err := rand.Read(token); err != nil {
+		return "", "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(token)
+
+	return encoded, HashToken(encoded), nil
+}
+
+// HashToken hashes an API token, tokens are long and random so a plain SHA-256 is enough
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// PBKDF2 with HMAC-SHA256 as described in RFC 8018
+func pbkdf2(password []byte, salt []byte, iterations int, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := []byte{}
+
+	for block := uint32(1); len(key) < length; block++ {
+		counter := make([]byte, 4)
+		binary.BigEndian.PutUint32(counter, block)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:length]
+}
+
+func encode(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
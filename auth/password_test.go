@@ -0,0 +1,68 @@
+// tsadmin/auth
+package auth
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The PBKDF2-HMAC-SHA256 test vectors from section 11 of RFC 7914
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{
+			password:   "passwd",
+			salt:       "salt",
+			iterations: 1,
+			key: "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783",
+		},
+		{
+			password:   "Password",
+			salt:       "NaCl",
+			iterations: 80000,
+			key: "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d",
+		},
+	}
+
+	for _, test := range tests {
+		key := hex.EncodeToString(pbkdf2([]byte(test.password), []byte(test.salt), test.iterations, 64))
+
+		if key != test.key {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, key, test.key)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("hunter2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !CheckPassword("hunter2", hash) {
+		t.Error("the right password was rejected")
+	}
+
+	if CheckPassword("hunter3", hash) {
+		t.Error("the wrong password was accepted")
+	}
+
+	for _, invalid := range []string{"", "hunter2", "md5$1$c2FsdA$a2V5", "pbkdf2-sha256$x$c2FsdA$a2V5", "pbkdf2-sha256$1$c2FsdA$"} {
+		if CheckPassword("hunter2", invalid) {
+			t.Errorf("the invalid hash %q was accepted", invalid)
+		}
+	}
+
+	// Unknown users are checked against the dummy hash, it has to cost the same
+	// as a real one without matching anything
+	if CheckPassword("", dummyHash) {
+		t.Error("the dummy hash matched an empty password")
+	}
+}
@@ -0,0 +1,180 @@
+// tsadmin/auth
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jamesrwhite/tsadmin/config"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The roles people can be given, each can do everything the one before it can.
+// Nothing needs more than an operator yet so admins can do the same things.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Permission is something a route needs the person making the request to be allowed to do
+type Permission string
+
+const (
+	// Anyone can use the route, even without logging in
+	PermissionNone Permission = ""
+	// Read metrics, statuses, alerts and history
+	PermissionView Permission = "view"
+	// Change things on the databases such as killing queries, and start maintenance
+	PermissionOperate Permission = "operate"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleViewer:   {PermissionView},
+	RoleOperator: {PermissionView, PermissionOperate},
+	RoleAdmin:    {PermissionView, PermissionOperate},
+}
+
+// Can reports whether the request is allowed the permission for databases in the group.
+// Everything is allowed when auth is turned off.
+func (a *Auth) Can(r *http.Request, permission Permission, group string) bool {
+	return a.can(r, permission, func(grant config.RoleGrant) bool {
+		return config.Matches(grant.Groups, group)
+	})
+}
+
+// CanAny reports whether the request is allowed the permission for at least one group
+func (a *Auth) CanAny(r *http.Request, permission Permission) bool {
+	return a.can(r, permission, func(config.RoleGrant) bool {
+		return true
+	})
+}
+
+func (a *Auth) can(r *http.Request, permission Permission, inScope func(config.RoleGrant) bool) bool {
+	if permission == PermissionNone || !enabled(a.settings()) {
+		return true
+	}
+
+	for _, grant := range a.Grants(r) {
+		if inScope(grant) && allows(grant.Role, permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Grants returns the roles given to whoever made the request, anyone without a
+// role of their own gets the default role for every group
+func (a *Auth) Grants(r *http.Request) []config.RoleGrant {
+	settings := a.settings()
+	identity := FromRequest(r)
+	grants := []config.RoleGrant{}
+
+	if identity == nil {
+		return grants
+	}
+
+	for _, grant := range settings.Roles {
+		if identity.Method == MethodToken && grant.Token == identity.Name {
+			grants = append(grants, grant)
+		} else if identity.Method != MethodToken && grant.User == identity.Name {
+			grants = append(grants, grant)
+		}
+	}
+
+	if len(grants) == 0 && settings.DefaultRole != "" {
+		grants = append(grants, config.RoleGrant{Role: settings.DefaultRole})
+	}
+
+	return grants
+}
+
+// GrantedRole is a role given to whoever made the request and what it lets them do
+type GrantedRole struct {
+	config.RoleGrant
+	Permissions []Permission `json:"permissions"`
+}
+
+// GrantedRoles returns the roles given to whoever made the request along with the
+// permissions of each, so the dashboard doesn't need to know what roles allow
+func (a *Auth) GrantedRoles(r *http.Request) []GrantedRole {
+	granted := []GrantedRole{}
+
+	for _, grant := range a.Grants(r) {
+		permissions := rolePermissions[grant.Role]
+
+		if permissions == nil {
+			permissions = []Permission{}
+		}
+
+		granted = append(granted, GrantedRole{RoleGrant: grant, Permissions: permissions})
+	}
+
+	return granted
+}
+
+// Router wraps httprouter so that every route has to say which permission it needs
+type Router struct {
+	router  *httprouter.Router
+	auth    *Auth
+	groupOf func(name string) string
+}
+
+// Router returns a router that checks permissions with a. Routes with a :name
+// parameter are checked against the group of that database, as given by groupOf,
+// and other routes against any group.
+func (a *Auth) Router(router *httprouter.Router, groupOf func(name string) string) *Router {
+	return &Router{router: router, auth: a, groupOf: groupOf}
+}
+
+func (r *Router) Handle(method string, path string, permission Permission, handle httprouter.Handle) {
+	r.router.Handle(method, path, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		var allowed bool
+
+		if name := ps.ByName("name"); name != "" {
+			allowed = r.auth.Can(req, permission, r.groupOf(strings.TrimSuffix(name, ".json")))
+		} else {
+			allowed = r.auth.CanAny(req, permission)
+		}
+
+		if !allowed {
+			jsonError(w, http.StatusForbidden, fmt.Sprintf("you need the %s permission to do that", permission))
+			return
+		}
+
+		handle(w, req, ps)
+	})
+}
+
+func (r *Router) GET(path string, permission Permission, handle httprouter.Handle) {
+	r.Handle("GET", path, permission, handle)
+}
+
+func (r *Router) POST(path string, permission Permission, handle httprouter.Handle) {
+	r.Handle("POST", path, permission, handle)
+}
+
+func (r *Router) DELETE(path string, permission Permission, handle httprouter.Handle) {
+	r.Handle("DELETE", path, permission, handle)
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.router.ServeHTTP(w, req)
+}
+
+// Whether the role includes the permission
+func allows(role string, permission Permission) bool {
+	for _, allowed := range rolePermissions[role] {
+		if allowed == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+func enabled(settings config.AuthConfig) bool {
+	return settings.UsersFile != "" || len(settings.Tokens) > 0
+}
@@ -0,0 +1,103 @@
+// tsadmin/auth
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+const sessionCookie = "tsadmin_session"
+
+// sessions are kept in memory, restarting tsadmin logs everyone out
+type sessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	identity Identity
+	expires  time.Time
+}
+
+func newSessions() *sessions {
+	return &sessions{sessions: make(map[string]*session)}
+}
+
+// Start a session for the given identity, returning its ID
+func (s *sessions) start(identity *Identity, ttl time.Duration) (string, error) {
+	id := make([]byte, tokenLength)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+
+	// Clear out the sessions nobody logged out of
+	for key, existing := range s.sessions {
+		if now.After(existing.expires) {
+			delete(s.sessions, key)
+		}
+	}
+
+	key := base64.RawURLEncoding.EncodeToString(id)
+	s.sessions[key] = &session{identity: *identity, expires: now.Add(ttl)}
+
+	return key, nil
+}
+
+func (s *sessions) get(id string) *Identity {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, ok := s.sessions[id]
+
+	if !ok || time.Now().After(existing.expires) {
+		return nil
+	}
+
+	identity := existing.identity
+
+	return &identity
+}
+
+func (s *sessions) end(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, id)
+}
+
+// Sessions started by logging in to the dashboard
+type sessionProvider struct {
+	auth *Auth
+}
+
+func (p *sessionProvider) Authenticate(r *http.Request, settings config.AuthConfig) *Identity {
+	cookie, err := r.Cookie(sessionCookie)
+
+	if err != nil {
+		return nil
+	}
+
+	identity := p.auth.sessions.get(cookie.Value)
+
+	if identity == nil || settings.UsersFile == "" {
+		return nil
+	}
+
+	// Make sure they haven't been removed from the users file since they logged in
+	if _, ok, err := p.auth.users.lookup(settings.UsersFile, identity.Name); err != nil || !ok {
+		return nil
+	}
+
+	return identity
+}
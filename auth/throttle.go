@@ -0,0 +1,151 @@
+// tsadmin/auth
+package auth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How many passwords someone can get wrong before they have to wait, after
+	// that each failure doubles the wait starting from a second
+	freeLoginFailures = 3
+	maxLoginBackoff   = 5 * time.Minute
+	// Failures are forgotten once there haven't been any for this long
+	forgetLoginFailures = 15 * time.Minute
+)
+
+// throttle slows down password guessing, both from an address and for a username
+// from an address
+type throttle struct {
+	mutex    sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+func newThrottle() *throttle {
+	return &throttle{failures: make(map[string]*loginFailures)}
+}
+
+// How long until any of the keys can try again
+func (t *throttle) wait(now time.Time, keys ...string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var longest time.Duration
+
+	for _, key := range keys {
+		failures, ok := t.failures[key]
+
+		if !ok || failures.count < freeLoginFailures {
+			continue
+		}
+
+		backoff := time.Second << uint(failures.count-freeLoginFailures)
+
+		if backoff > maxLoginBackoff || backoff <= 0 {
+			backoff = maxLoginBackoff
+		}
+
+		if remaining := failures.last.Add(backoff).Sub(now); remaining > longest {
+			longest = remaining
+		}
+	}
+
+	return longest
+}
+
+// Count a failed attempt against each of the keys
+func (t *throttle) failed(now time.Time, keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, failures := range t.failures {
+		if now.Sub(failures.last) > forgetLoginFailures {
+			delete(t.failures, key)
+		}
+	}
+
+	for _, key := range keys {
+		failures, ok := t.failures[key]
+
+		if !ok {
+			failures = &loginFailures{}
+			t.failures[key] = failures
+		}
+
+		failures.count++
+		failures.last = now
+	}
+}
+
+// Forget the failures of the keys after someone gets it right
+func (t *throttle) succeeded(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(t.failures, key)
+	}
+}
+
+// The address a request came from without its port. Behind a proxy every request
+// comes from the proxy so if it's one we trust we go by the addresses it says it
+// forwarded the request for, the last one we don't trust is the client.
+func clientAddress(r *http.Request, trustedProxies []string) string {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		address = r.RemoteAddr
+	}
+
+	if !trusted(address, trustedProxies) {
+		return address
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+
+		if hop == "" {
+			continue
+		}
+
+		address = hop
+
+		if !trusted(hop, trustedProxies) {
+			break
+		}
+	}
+
+	return address
+}
+
+// Whether the address is one of the proxies, which can be addresses or CIDR ranges
+func trusted(address string, proxies []string) bool {
+	ip := net.ParseIP(address)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range proxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,60 @@
+// tsadmin/auth
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	throttle := newThrottle()
+	now := time.Now()
+
+	for i := 0; i < freeLoginFailures; i++ {
+		if wait := throttle.wait(now, "user:jw"); wait != 0 {
+			t.Fatalf("had to wait %s after %d failures", wait, i)
+		}
+
+		throttle.failed(now, "user:jw", "address:10.0.0.1")
+	}
+
+	if wait := throttle.wait(now, "user:jw"); wait != time.Second {
+		t.Errorf("waited %s after %d failures, want 1s", wait, freeLoginFailures)
+	}
+
+	// Another user from the same address waits too
+	if wait := throttle.wait(now, "user:bob", "address:10.0.0.1"); wait != time.Second {
+		t.Errorf("waited %s from the same address, want 1s", wait)
+	}
+
+	throttle.failed(now, "user:jw")
+
+	if wait := throttle.wait(now, "user:jw"); wait != 2*time.Second {
+		t.Errorf("waited %s after another failure, want 2s", wait)
+	}
+
+	if wait := throttle.wait(now.Add(2*time.Second), "user:jw"); wait != 0 {
+		t.Errorf("still waiting %s once the backoff is over", wait)
+	}
+
+	for i := 0; i < 30; i++ {
+		throttle.failed(now, "user:jw")
+	}
+
+	if wait := throttle.wait(now, "user:jw"); wait != maxLoginBackoff {
+		t.Errorf("waited %s after lots of failures, want %s", wait, maxLoginBackoff)
+	}
+
+	throttle.succeeded("user:jw")
+
+	if wait := throttle.wait(now, "user:jw"); wait != 0 {
+		t.Errorf("waited %s after getting it right", wait)
+	}
+
+	// Failures are forgotten about eventually
+	throttle.failed(now.Add(forgetLoginFailures+time.Minute), "user:bob")
+
+	if _, ok := throttle.failures["address:10.0.0.1"]; ok {
+		t.Error("old failures were kept")
+	}
+}
@@ -0,0 +1,82 @@
+// tsadmin/auth
+package auth
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// users reads the users file, a username:hash pair per line. The file is read
+// again whenever it changes so users can be added without a restart.
+type users struct {
+	mutex    sync.Mutex
+	path     string
+	modified time.Time
+	hashes   map[string]string
+}
+
+// The password hash of the given user
+func (u *users) lookup(path string, username string) (string, bool, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if err := u.load(path); err != nil {
+		return "", false, err
+	}
+
+	hash, ok := u.hashes[username]
+
+	return hash, ok, nil
+}
+
+func (u *users) load(path string) error {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return err
+	}
+
+	// Nothing has changed since we last read it
+	if path == u.path && info.ModTime().Equal(u.modified) {
+		return nil
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip blank lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+
+		if len(parts) == 2 {
+			hashes[parts[0]] = parts[1]
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	u.path = path
+	u.modified = info.ModTime()
+	u.hashes = hashes
+
+	return nil
+}
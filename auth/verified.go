@@ -0,0 +1,54 @@
+// tsadmin/auth
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// How long a password that checked out is trusted without hashing it again
+const verifiedFor = time.Minute
+
+// verified remembers the passwords that recently checked out. They're keyed on a
+// hash of the username, password and the user's password hash so changing the
+// users file stops the old password working straight away.
+type verified struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time
+}
+
+func newVerified() *verified {
+	return &verified{expires: make(map[string]time.Time)}
+}
+
+// Whether the password recently checked out
+func (v *verified) check(now time.Time, username string, password string, hash string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	expires, ok := v.expires[verifiedKey(username, password, hash)]
+
+	return ok && now.Before(expires)
+}
+
+// Remember that the password checked out
+func (v *verified) add(now time.Time, username string, password string, hash string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for key, expires := range v.expires {
+		if !now.Before(expires) {
+			delete(v.expires, key)
+		}
+	}
+
+	v.expires[verifiedKey(username, password, hash)] = now.Add(verifiedFor)
+}
+
+func verifiedKey(username string, password string, hash string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + hash))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -3,14 +3,194 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jamesrwhite/tsadmin/database"
 )
 
+// Defaults for anything not set in the config file
+const (
+	defaultWorkers          = 10
+	defaultTimeout          = 900 * time.Millisecond
+	defaultHistoryRetention = 15 * time.Minute
+	defaultRawRetention     = 6 * time.Hour
+	defaultMinuteRetention  = 30 * 24 * time.Hour
+	defaultHourRetention    = 365 * 24 * time.Hour
+	defaultGroupWait        = 10 * time.Second
+	defaultMinInterval      = time.Minute
+	defaultMaintenanceFile  = "maintenance.json"
+	defaultAuditFile        = "audit.jsonl"
+	defaultKillAction       = "report"
+	defaultMaxKills         = 10
+	defaultKillsPer         = time.Minute
+	defaultStatementsEvery  = time.Minute
+	defaultSessionTTL       = 12 * time.Hour
+	defaultRole             = "viewer"
+)
+
 type Config struct {
-	Databases []database.Database `json:"databases"`
+	Databases        []database.Database `json:"databases"`
+	Workers          int                 `json:"workers"`
+	Timeout          Duration            `json:"timeout"`
+	HistoryRetention Duration            `json:"history_retention"`
+	Storage          StorageConfig       `json:"storage"`
+	Alerts           []AlertRule         `json:"alerts"`
+	Notifications    NotificationConfig  `json:"notifications"`
+	MaintenanceFile  string              `json:"maintenance_file"`
+	AuditFile        string              `json:"audit_file"`
+	KillPolicies     []KillPolicy        `json:"kill_policies"`
+	StatementsEvery  Duration            `json:"statements_interval"`
+	Auth             AuthConfig          `json:"auth"`
+	Health           bool                `json:"health"`
+}
+
+// Where and for how long metrics are stored on disk, storage is disabled if no path is set
+type StorageConfig struct {
+	Path            string   `json:"path"`
+	RawRetention    Duration `json:"raw_retention"`
+	MinuteRetention Duration `json:"minute_retention"`
+	HourRetention   Duration `json:"hour_retention"`
+}
+
+// An alert rule, the alert fires for a database once expr has been true for long
+// enough. If resolve is set the alert only resolves once that is true, otherwise
+// it resolves as soon as expr is false.
+type AlertRule struct {
+	Name        string   `json:"name"`
+	Expr        string   `json:"expr"`
+	For         Duration `json:"for"`
+	Resolve     string   `json:"resolve"`
+	Severity    string   `json:"severity"`
+	Description string   `json:"description"`
+	Groups      []string `json:"groups"`
+	Databases   []string `json:"databases"`
+}
+
+// Where alert notifications are sent. Notifications are held for group_wait so
+// alerts that change together go out together, and each receiver is sent at most
+// one message every min_interval.
+type NotificationConfig struct {
+	Receivers   []Receiver `json:"receivers"`
+	Routes      []Route    `json:"routes"`
+	GroupWait   Duration   `json:"group_wait"`
+	MinInterval Duration   `json:"min_interval"`
+}
+
+// A receiver is a webhook, a Slack incoming webhook or a list of email addresses.
+// The subject and template are Go text/template strings.
+type Receiver struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	SMTPHost string            `json:"smtp_host"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	From     string            `json:"from"`
+	To       []string          `json:"to"`
+	Subject  string            `json:"subject"`
+	Template string            `json:"template"`
+}
+
+// A route sends the alerts matching it to a receiver, empty lists match everything
+type Route struct {
+	Receiver   string   `json:"receiver"`
+	Groups     []string `json:"groups"`
+	Databases  []string `json:"databases"`
+	Severities []string `json:"severities"`
+}
+
+// Who can use the dashboard and API, auth is turned on by setting a users file
+// or some API tokens. The users file has a username:hash pair on each line. The
+// trusted proxies are addresses or CIDR ranges whose X-Forwarded-For we believe.
+type AuthConfig struct {
+	UsersFile      string      `json:"users_file"`
+	Tokens         []APIToken  `json:"tokens"`
+	SessionTTL     Duration    `json:"session_ttl"`
+	Roles          []RoleGrant `json:"roles"`
+	DefaultRole    string      `json:"default_role"`
+	TrustedProxies []string    `json:"trusted_proxies"`
+}
+
+// A role given to a user or an API token, for the listed groups or every group if there are none
+type RoleGrant struct {
+	User   string   `json:"user,omitempty"`
+	Token  string   `json:"token,omitempty"`
+	Role   string   `json:"role"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// An API token for scripts and other machines, only the SHA-256 hash of the token is kept
+type APIToken struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// A kill policy finds threads on the matching databases that match all of its
+// rules and either reports them or kills them. Empty rules match everything.
+// Policies kill at most max_kills threads every per, dry_run reports what would
+// have been killed without killing anything.
+type KillPolicy struct {
+	Name      string   `json:"name"`
+	Groups    []string `json:"groups"`
+	Databases []string `json:"databases"`
+	Users     []string `json:"users"`
+	Schemas   []string `json:"dbs"`
+	Commands  []string `json:"commands"`
+	Match     string   `json:"match"`
+	MinTime   Duration `json:"min_time"`
+	Action    string   `json:"action"`
+	DryRun    bool     `json:"dry_run"`
+	MaxKills  int      `json:"max_kills"`
+	Per       Duration `json:"per"`
+}
+
+// Duration is a time.Duration that can be written as a string such as "2m" in the config
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("durations must be strings such as \"30s\": %s", err)
+	}
+
+	duration, err := ParseDuration(value)
+
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+
+	return nil
+}
+
+// ParseDuration is time.ParseDuration with support for days, such as "30d"
+func ParseDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", value)
+		}
+
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
 }
 
 func Load(configPath string) (Config, error) {
@@ -24,6 +204,8 @@ func Load(configPath string) (Config, error) {
 		return config, err
 	}
 
+	defer configFile.Close()
+
 	// Decode the JSON
 	parser := json.NewDecoder(configFile)
 
@@ -31,5 +213,105 @@ func Load(configPath string) (Config, error) {
 		return config, err
 	}
 
+	// Fill in the defaults
+	if config.Workers <= 0 {
+		config.Workers = defaultWorkers
+	}
+
+	if config.Timeout.Duration <= 0 {
+		config.Timeout.Duration = defaultTimeout
+	}
+
+	if config.HistoryRetention.Duration <= 0 {
+		config.HistoryRetention.Duration = defaultHistoryRetention
+	}
+
+	if config.Storage.RawRetention.Duration <= 0 {
+		config.Storage.RawRetention.Duration = defaultRawRetention
+	}
+
+	if config.Storage.MinuteRetention.Duration <= 0 {
+		config.Storage.MinuteRetention.Duration = defaultMinuteRetention
+	}
+
+	if config.Storage.HourRetention.Duration <= 0 {
+		config.Storage.HourRetention.Duration = defaultHourRetention
+	}
+
+	if config.Notifications.GroupWait.Duration <= 0 {
+		config.Notifications.GroupWait.Duration = defaultGroupWait
+	}
+
+	if config.Notifications.MinInterval.Duration <= 0 {
+		config.Notifications.MinInterval.Duration = defaultMinInterval
+	}
+
+	if config.Auth.SessionTTL.Duration <= 0 {
+		config.Auth.SessionTTL.Duration = defaultSessionTTL
+	}
+
+	if config.Auth.DefaultRole == "" {
+		config.Auth.DefaultRole = defaultRole
+	}
+
+	for _, proxy := range config.Auth.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return config, fmt.Errorf("trusted proxy %s should be an address or a CIDR range", proxy)
+		}
+	}
+
+	if config.MaintenanceFile == "" {
+		config.MaintenanceFile = defaultMaintenanceFile
+	}
+
+	if config.StatementsEvery.Duration <= 0 {
+		config.StatementsEvery.Duration = defaultStatementsEvery
+	}
+
+	if config.AuditFile == "" {
+		config.AuditFile = defaultAuditFile
+	}
+
+	for i := range config.KillPolicies {
+		policy := &config.KillPolicies[i]
+
+		if policy.Action == "" {
+			policy.Action = defaultKillAction
+		}
+
+		if policy.Action != "report" && policy.Action != "kill-query" && policy.Action != "kill-connection" {
+			return config, fmt.Errorf("kill policy %s has an unknown action %s, it should be report, kill-query or kill-connection", policy.Name, policy.Action)
+		}
+
+		if policy.MaxKills <= 0 {
+			policy.MaxKills = defaultMaxKills
+		}
+
+		if policy.Per.Duration <= 0 {
+			policy.Per.Duration = defaultKillsPer
+		}
+	}
+
+	for i := range config.Databases {
+		config.Databases[i].Timeout = config.Timeout.Duration
+	}
+
 	return config, nil
 }
+
+// Matches reports whether the value is in a list from the config such as the
+// groups or databases of a rule, an empty list means everything
+func Matches(list []string, value string) bool {
+	return len(list) == 0 || Contains(list, value)
+}
+
+// Contains reports whether the value is in the list
+func Contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
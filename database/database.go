@@ -2,124 +2,321 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
 	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
+// The possible states of a database
+const (
+	StateOK          = "ok"
+	StateUnreachable = "unreachable"
+	StateAuthFailed  = "auth-failed"
+	StateQueryError  = "query-error"
+)
+
+// MySQL errors returned when the credentials we have are no good
+const (
+	errDBAccessDenied = 1044
+	errAccessDenied   = 1045
+)
+
+// How many rows each query can examine on average before we say a database is
+// scanning tables rather than using indexes
+const tableScanRows = 1000
+
 type Database struct {
-	Name     string `json:"name"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	User     string `json:"username"`
-	Password string `json:"password"`
+	Name     string        `json:"name"`
+	Host     string        `json:"host"`
+	Port     int           `json:"port"`
+	User     string        `json:"username"`
+	Password string        `json:"password"`
+	Group    string        `json:"group"`
+	Timeout  time.Duration `json:"-"`
 }
 
 type DatabaseStatus struct {
-	Metadata  DatabaseMetadata  `json:"metadata"`
-	Metrics   DatabaseMetrics   `json:"metrics"`
-	Variables DatabaseVariables `json:"variables"`
+	Metadata            DatabaseMetadata    `json:"metadata"`
+	State               string              `json:"state"`
+	Error               string              `json:"error"`
+	LastSuccess         *time.Time          `json:"last_success"`
+	ConsecutiveFailures int                 `json:"consecutive_failures"`
+	Maintenance         bool                `json:"maintenance"`
+	CollectionDuration  float64             `json:"collection_duration"`
+	CollectedAt         time.Time           `json:"collected_at"`
+	Metrics             DatabaseMetrics     `json:"metrics"`
+	Variables           DatabaseVariables   `json:"variables"`
+	Replication         DatabaseReplication `json:"replication"`
+	InnoDB              DatabaseInnoDB      `json:"innodb"`
 }
 
 type DatabaseMetadata struct {
-	Name string `json:"name"`
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	Name    string `json:"name"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Group   string `json:"group"`
+	Flavor  string `json:"flavor"`
+	Version string `json:"version"`
 }
 
 type DatabaseMetrics struct {
-	CurrentConnections          int `json:"current_connections"`
-	ConnectionsPerSecond        int `json:"connections_per_second"`
-	AbortedConnectionsPerSecond int `json:"aborted_connections_per_second"`
-	QueriesPerSecond            int `json:"queries_per_second"`
-	ReadsPerSecond              int `json:"reads_per_second"`
-	WritesPerSecond             int `json:"writes_per_second"`
-	Uptime                      int `json:"uptime"`
-	connections                 int
-	abortedConnections          int
-	queries                     int
-	reads                       int
-	writes                      int
+	CurrentConnections          int         `json:"current_connections"`
+	ConnectionsPerSecond        float64     `json:"connections_per_second"`
+	AbortedConnectionsPerSecond float64     `json:"aborted_connections_per_second"`
+	AbortedClientsPerSecond     float64     `json:"aborted_clients_per_second"`
+	BytesReceivedPerSecond      float64     `json:"bytes_received_per_second"`
+	BytesSentPerSecond          float64     `json:"bytes_sent_per_second"`
+	QueriesPerSecond            float64     `json:"queries_per_second"`
+	ReadsPerSecond              float64     `json:"reads_per_second"`
+	WritesPerSecond             float64     `json:"writes_per_second"`
+	RowsReadPerSecond           float64     `json:"innodb_rows_read_per_second"`
+	RowsInsertedPerSecond       float64     `json:"innodb_rows_inserted_per_second"`
+	RowsUpdatedPerSecond        float64     `json:"innodb_rows_updated_per_second"`
+	RowsDeletedPerSecond        float64     `json:"innodb_rows_deleted_per_second"`
+	HandlerReadRndNextPerSecond float64     `json:"handler_read_rnd_next_per_second"`
+	HandlerReadKeyPerSecond     float64     `json:"handler_read_key_per_second"`
+	RowsExaminedPerQuery        float64     `json:"rows_examined_per_query"`
+	TableScans                  bool        `json:"table_scans"`
+	TmpTablesPerSecond          float64     `json:"tmp_tables_per_second"`
+	TmpDiskTablesPerSecond      float64     `json:"tmp_disk_tables_per_second"`
+	TmpFilesPerSecond           float64     `json:"tmp_files_per_second"`
+	DiskTmpTableRatio           float64     `json:"disk_tmp_table_ratio"`
+	SortMergePassesPerSecond    float64     `json:"sort_merge_passes_per_second"`
+	SelectFullJoinPerSecond     float64     `json:"select_full_join_per_second"`
+	SelectScanPerSecond         float64     `json:"select_scan_per_second"`
+	TableLocksWaitedPerSecond   float64     `json:"table_locks_waited_per_second"`
+	Uptime                      int         `json:"uptime"`
+	QueriesLoad                 LoadAverage `json:"queries_load"`
+	ReadsLoad                   LoadAverage `json:"reads_load"`
+	WritesLoad                  LoadAverage `json:"writes_load"`
+	counters                    map[string]float64
+	sampledAt                   time.Time
 }
 
 type DatabaseVariables struct {
-	MaxConnections int `json:"max_connections"`
+	MaxConnections   int    `json:"max_connections"`
+	MaxAllowedPacket int    `json:"max_allowed_packet"`
+	TmpTableSize     int    `json:"tmp_table_size"`
+	MaxHeapTableSize int    `json:"max_heap_table_size"`
+	SortBufferSize   int    `json:"sort_buffer_size"`
+	ServerID         int    `json:"server_id"`
+	ServerUUID       string `json:"server_uuid"`
+	ReadOnly         bool   `json:"read_only"`
 }
 
 func (db *Database) String() string {
 	return fmt.Sprintf("%s:%s@tcp(%s:%d)/information_schema", db.User, db.Password, db.Host, db.Port)
 }
 
-func Status(db Database, previous *DatabaseStatus) (*DatabaseStatus, error) {
-	status := &DatabaseStatus{
+// The DSN to connect with, the driver doesn't know about contexts so we also
+// pass the timeout on as connect and read/write timeouts
+func (db *Database) dsn() string {
+	dsn := db.String()
+
+	if db.Timeout > 0 {
+		dsn = fmt.Sprintf("%s?timeout=%s&readTimeout=%s&writeTimeout=%s", dsn, db.Timeout, db.Timeout, db.Timeout)
+	}
+
+	return dsn
+}
+
+// Fetch the current status of the given database, if this fails the returned status
+// describes what went wrong along with the error itself
+func Status(ctx context.Context, pool *Pool, db Database, previous *DatabaseStatus) (*DatabaseStatus, error) {
+	start := time.Now()
+	status := newStatus(db)
+
+	// Get the connection pool for the database
+	conn, err := pool.Get(db)
+
+	if err != nil {
+		status.CollectedAt = start
+
+		return failed(status, previous, err), err
+	}
+
+	// Collect in the background so we can give up as soon as the deadline passes
+	// even if the driver is still waiting on the server
+	collected := newStatus(db)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- collect(ctx, pool, db, conn, previous, collected)
+	}()
+
+	select {
+	case err = <-done:
+		if err == nil {
+			status = collected
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	status.CollectionDuration = time.Since(start).Seconds()
+	status.CollectedAt = start
+
+	if err != nil {
+		pool.Failed(db)
+
+		return failed(status, previous, err), err
+	}
+
+	pool.Succeeded(db)
+
+	now := time.Now()
+	status.State = StateOK
+	status.LastSuccess = &now
+
+	return status, nil
+}
+
+func newStatus(db Database) *DatabaseStatus {
+	return &DatabaseStatus{
 		Metadata: DatabaseMetadata{
-			Name: db.Name,
-			Host: db.Host,
-			Port: db.Port,
+			Name:  db.Name,
+			Host:  db.Host,
+			Port:  db.Port,
+			Group: db.Group,
 		},
-		Metrics:   DatabaseMetrics{},
-		Variables: DatabaseVariables{},
+		Metrics:     DatabaseMetrics{counters: make(map[string]float64)},
+		Variables:   DatabaseVariables{},
+		Replication: DatabaseReplication{},
+	}
+}
+
+// Fetch the metrics, variables and replication status of the database
+func collect(ctx context.Context, pool *Pool, db Database, conn *sql.DB, previous *DatabaseStatus, status *DatabaseStatus) error {
+	// Work out what we are talking to
+	server, err := pool.Server(ctx, db, conn)
+
+	if err != nil {
+		return err
 	}
 
+	status.Metadata.Flavor = server.Flavor
+	status.Metadata.Version = server.Version
+
 	// Fetch the metrics
-	err := execQuery(db, "metrics", previous, status)
+	status.Metrics.sampledAt = time.Now()
+	err = execQuery(ctx, conn, server, "metrics", status)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	// Work out the rates by comparing them to the previous metrics
+	postProcessMetrics(previous, status)
+
 	// Fetch the variables
-	err = execQuery(db, "variables", previous, status)
+	err = execQuery(ctx, conn, server, "variables", status)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return status, nil
+	// Fetch the replication status
+	return execReplicationQuery(ctx, conn, server, status)
 }
 
-// Execute a query on the given database for looking up metrics/variables
-func execQuery(db Database, queryType string, previous *DatabaseStatus, status *DatabaseStatus) error {
-	var (
-		key   string
-		value string
-		table string
-	)
+// Mark the status as failed, discarding anything we managed to partially collect
+func failed(status *DatabaseStatus, previous *DatabaseStatus, err error) *DatabaseStatus {
+	// We didn't actually try the database this time so just carry on as we were
+	if _, ok := err.(*BackoffError); ok && previous != nil {
+		status.State = previous.State
+		status.Error = previous.Error
+		status.LastSuccess = previous.LastSuccess
+		status.ConsecutiveFailures = previous.ConsecutiveFailures
+		status.Variables = previous.Variables
+		status.Replication = previous.Replication
+		status.Metrics = previous.Metrics.baseline()
+
+		return status
+	}
 
-	// Fetch all the db metrics/variables
-	if queryType == "metrics" {
-		table = "GLOBAL_STATUS"
-	} else if queryType == "variables" {
-		table = "GLOBAL_VARIABLES"
-	} else {
-		log.Fatal("Unknown queryType")
+	status.State = stateFromError(err)
+	status.Error = err.Error()
+	status.Metrics = DatabaseMetrics{counters: make(map[string]float64)}
+	status.Variables = DatabaseVariables{}
+	status.Replication = DatabaseReplication{}
+	status.InnoDB = DatabaseInnoDB{}
+	status.ConsecutiveFailures = 1
+
+	if previous != nil {
+		status.LastSuccess = previous.LastSuccess
+		status.ConsecutiveFailures = previous.ConsecutiveFailures + 1
+
+		// The variables and who we replicate from rarely change so hang on to
+		// them, we need the server_uuid and master_uuid to place the host in the
+		// topology. Alerting ignores them as Values() stops at the state.
+		status.Variables = previous.Variables
+		status.Replication = previous.Replication
+
+		// Keep the last good counters as the baseline for the next rates
+		status.Metrics = previous.Metrics.baseline()
 	}
 
-	// Connect to the database
-	conn, err := sql.Open("mysql", db.String())
+	return status
+}
 
-	if err != nil {
-		return err
+// Work out what state a database is in based on the error we got back from it
+func stateFromError(err error) string {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+
+	// Anything that isn't a MySQL error means we couldn't talk to the server
+	if !ok {
+		return StateUnreachable
 	}
 
-	defer conn.Close()
+	switch mysqlErr.Number {
+	case errDBAccessDenied, errAccessDenied:
+		return StateAuthFailed
+	default:
+		return StateQueryError
+	}
+}
 
-	// Put MySQL in 5.6 compatability mode as the location of some of the metrics has chagned in 5.7
-	_, err = conn.Query("SET GLOBAL show_compatibility_56 = ON")
+// Execute a query on the given database for looking up metrics/variables
+func execQuery(ctx context.Context, conn *sql.DB, server *Server, queryType string, status *DatabaseStatus) error {
+	// Work out where to fetch the db metrics/variables from
+	query, err := server.globalsQuery(queryType)
 
 	if err != nil {
 		return err
 	}
 
-	// Fetch all the db metrics
-	rows, err := conn.Query(fmt.Sprintf("SELECT VARIABLE_NAME AS 'key', VARIABLE_VALUE AS 'value' FROM %s", table))
+	count, err := execGlobalsQuery(ctx, conn, query, queryType, status)
+
+	// performance_schema may be turned off in which case the tables are empty, or
+	// we may not be allowed to read it, either way SHOW GLOBAL works everywhere
+	_, isMySQLErr := err.(*mysql.MySQLError)
+
+	if (err == nil && count == 0) || isMySQLErr {
+		_, err = execGlobalsQuery(ctx, conn, server.fallbackGlobalsQuery(queryType), queryType, status)
+	}
+
+	return err
+}
+
+// Read the key/value rows returned by the given query, returning how many there were
+func execGlobalsQuery(ctx context.Context, conn *sql.DB, query string, queryType string, status *DatabaseStatus) (int, error) {
+	var (
+		key   string
+		value sql.NullString
+		count int
+	)
+
+	// Fetch all the db metrics/variables
+	rows, err := conn.QueryContext(ctx, query)
 
 	// Handle query errors
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	defer rows.Close()
@@ -130,161 +327,96 @@ func execQuery(db Database, queryType string, previous *DatabaseStatus, status *
 
 		// Handle row reading errors
 		if err != nil {
-			return err
+			return count, err
 		}
 
+		count++
+
+		// performance_schema and SHOW GLOBAL return the names in mixed case
+		key = strings.ToUpper(key)
+
 		// Process the metrics/variables
 		if queryType == "metrics" {
-			err = processMetric(previous, status, key, value)
+			err = processMetric(status, key, value.String)
 		} else {
-			err = processVariable(status, key, value)
+			err = processVariable(status, key, value.String)
 		}
 
 		if err != nil {
-			return err
+			return count, err
 		}
 	}
 
-	// Do some final processing of the metrics
-	err = postProcessMetrics(previous, status)
-
-	if err != nil {
-		return err
-	}
-
 	// Check for any remaining errors
-	err = rows.Err()
-
-	return err
+	return count, rows.Err()
 }
 
 // Process metric returned from the GLOBAL_STATUS table
-func processMetric(previous *DatabaseStatus, status *DatabaseStatus, key string, value string) error {
-	var (
-		err                error
-		currentConnections int
-		connections        int
-		diff               int
-		abortedConnections int
-		queries            int
-		uptime             int
-		readWriteValue     int
-	)
+func processMetric(status *DatabaseStatus, key string, value string) error {
+	number, err := strconv.ParseFloat(value, 64)
+
+	// Some of the status values aren't numbers, we aren't interested in those
+	if err != nil {
+		return nil
+	}
+
+	// Hang on to the raw value, most of these are counters that we turn into rates
+	status.Metrics.counters[key] = number
 
 	switch key {
 	// Current connections
 	case "THREADS_CONNECTED":
-		currentConnections, err = strconv.Atoi(value)
-		status.Metrics.CurrentConnections = currentConnections
-	// Connections per second
-	case "CONNECTIONS":
-		connections, err = strconv.Atoi(value)
-
-		// If we don't have a previous value for the total connections
-		// then cps is technically 0 as we don't know it yet
-		if previous == nil || previous.Metrics.connections == 0 {
-			status.Metrics.ConnectionsPerSecond = 0
-			status.Metrics.connections = connections
-		// Otherwise the value of cps is the diff between the current
-		// and previous count of connections
-		} else {
-			diff = connections - previous.Metrics.connections
-
-			// cps can never be below 0..
-			if diff > 0 {
-				status.Metrics.ConnectionsPerSecond = diff
-			} else {
-				status.Metrics.ConnectionsPerSecond = 0
-			}
-
-			status.Metrics.connections = connections
-		}
-	// Aborted connections per second
-	case "ABORTED_CONNECTS":
-		abortedConnections, err = strconv.Atoi(value)
-
-		// If we don't have a previous value for the total aborted connections
-		// then acps is technically 0 as we don't know it yet
-		if previous == nil || previous.Metrics.abortedConnections == 0 {
-			status.Metrics.AbortedConnectionsPerSecond = 0
-			status.Metrics.abortedConnections = abortedConnections
-		// Otherwise the value of acps is the diff between the current
-		// and previous count of connections
-		} else {
-			diff = abortedConnections - previous.Metrics.abortedConnections
-
-			// acps can never be below 0..
-			if diff > 0 {
-				status.Metrics.AbortedConnectionsPerSecond = diff
-			} else {
-				status.Metrics.AbortedConnectionsPerSecond = 0
-			}
-
-			status.Metrics.abortedConnections = abortedConnections
-		}
-	// Queries per second
-	case "QUERIES":
-		queries, err = strconv.Atoi(value)
-
-		// If we don't have a previous value for the total queries
-		// then qps is technically 0 as we don't know it yet
-		if previous == nil || previous.Metrics.queries == 0 {
-			status.Metrics.QueriesPerSecond = 0
-			status.Metrics.queries = queries
-		// Otherwise the value of qps is the diff between the current
-		// and previous count of queries
-		} else {
-			diff = queries - previous.Metrics.queries
-
-			// qps can never be below 0..
-			if diff > 0 {
-				status.Metrics.QueriesPerSecond = diff
-			} else {
-				status.Metrics.QueriesPerSecond = 0
-			}
-
-			status.Metrics.queries = queries
-		}
-	// Read/Writes per second
-	case "COM_SELECT", "COM_INSERT_SELECT", "COM_REPLACE_SELECT", "COM_DELETE", "COM_INSERT", "COM_UPDATE", "COM_REPLACE":
-		readWriteValue, err = strconv.Atoi(value)
-
-		// Reads
-		if key == "COM_SELECT" || key == "COM_INSERT_SELECT" || key == "COM_REPLACE_SELECT" {
-			status.Metrics.reads += readWriteValue
-
-			// Reads/Writes
-			if key == "COM_INSERT_SELECT" || key == "COM_REPLACE_SELECT" {
-				status.Metrics.writes += readWriteValue
-			}
-		// Writes
-		} else {
-			status.Metrics.writes += readWriteValue
-		}
+		status.Metrics.CurrentConnections = int(number)
 	// Uptime
 	case "UPTIME":
-		uptime, err = strconv.Atoi(value)
-		status.Metrics.Uptime = uptime
+		status.Metrics.Uptime = int(number)
 	}
 
-	if err != nil {
-		return err
-	} else {
-		return nil
-	}
+	return nil
 }
 
 // Process variables returned from the GLOBAL_VARIABLES table
 func processVariable(status *DatabaseStatus, key string, value string) error {
 	var (
-		err            error
-		maxConnections int
+		err              error
+		maxConnections   int
+		maxAllowedPacket int
+		tmpTableSize     int
+		maxHeapTableSize int
+		sortBufferSize   int
+		serverID         int
 	)
 
+	switch key {
 	// Max allowed connections
-	if key == "MAX_CONNECTIONS" {
+	case "MAX_CONNECTIONS":
 		maxConnections, err = strconv.Atoi(value)
 		status.Variables.MaxConnections = maxConnections
+	// The biggest packet a client can send or receive
+	case "MAX_ALLOWED_PACKET":
+		maxAllowedPacket, err = strconv.Atoi(value)
+		status.Variables.MaxAllowedPacket = maxAllowedPacket
+	// In memory temporary tables go to disk once they are bigger than the
+	// smaller of these two
+	case "TMP_TABLE_SIZE":
+		tmpTableSize, err = strconv.Atoi(value)
+		status.Variables.TmpTableSize = tmpTableSize
+	case "MAX_HEAP_TABLE_SIZE":
+		maxHeapTableSize, err = strconv.Atoi(value)
+		status.Variables.MaxHeapTableSize = maxHeapTableSize
+	// Sorts that don't fit in the buffer need merge passes
+	case "SORT_BUFFER_SIZE":
+		sortBufferSize, err = strconv.Atoi(value)
+		status.Variables.SortBufferSize = sortBufferSize
+	// Server identity, used to work out who replicates from who
+	case "SERVER_ID":
+		serverID, err = strconv.Atoi(value)
+		status.Variables.ServerID = serverID
+	case "SERVER_UUID":
+		status.Variables.ServerUUID = value
+	// Replicas are usually read only
+	case "READ_ONLY":
+		status.Variables.ReadOnly = value == "ON" || value == "1"
 	}
 
 	if err != nil {
@@ -295,32 +427,76 @@ func processVariable(status *DatabaseStatus, key string, value string) error {
 }
 
 // Post processing of metrics
-func postProcessMetrics(previous *DatabaseStatus, status *DatabaseStatus) error {
-	var diff int
+func postProcessMetrics(previous *DatabaseStatus, status *DatabaseStatus) {
+	rates := newRates(previous, status)
 
-	// If we don't have a previous value for the total reads
-	// then rps is technically 0 as we don't know it yet
-	if previous != nil {
-		// Calculate the RPS
-		diff = status.Metrics.reads - previous.Metrics.reads
+	// Connections per second
+	status.Metrics.ConnectionsPerSecond = rates.of("CONNECTIONS")
 
-		// rps can never be below 0..
-		if diff > 0 {
-			status.Metrics.ReadsPerSecond = diff
-		} else {
-			status.Metrics.ReadsPerSecond = 0
-		}
+	// Aborted connections per second
+	status.Metrics.AbortedConnectionsPerSecond = rates.of("ABORTED_CONNECTS")
 
-		// Calculate the WPS
-		diff = status.Metrics.writes - previous.Metrics.writes
+	// Clients that went away without closing their connection properly
+	status.Metrics.AbortedClientsPerSecond = rates.of("ABORTED_CLIENTS")
 
-		// wps can never be below 0..
-		if diff > 0 {
-			status.Metrics.WritesPerSecond = diff
-		} else {
-			status.Metrics.WritesPerSecond = 0
-		}
+	// Network traffic in bytes per second
+	status.Metrics.BytesReceivedPerSecond = rates.of("BYTES_RECEIVED")
+	status.Metrics.BytesSentPerSecond = rates.of("BYTES_SENT")
+
+	// Queries per second
+	status.Metrics.QueriesPerSecond = rates.of("QUERIES")
+
+	// Reads per second, INSERT ... SELECT and REPLACE ... SELECT count as both
+	status.Metrics.ReadsPerSecond = rates.of("COM_SELECT", "COM_INSERT_SELECT", "COM_REPLACE_SELECT")
+
+	// Writes per second
+	status.Metrics.WritesPerSecond = rates.of("COM_DELETE", "COM_INSERT", "COM_UPDATE", "COM_REPLACE", "COM_INSERT_SELECT", "COM_REPLACE_SELECT")
+
+	// Rows InnoDB read and changed per second, these say how much work the
+	// statements are doing rather than how many there are
+	status.Metrics.RowsReadPerSecond = rates.of("INNODB_ROWS_READ")
+	status.Metrics.RowsInsertedPerSecond = rates.of("INNODB_ROWS_INSERTED")
+	status.Metrics.RowsUpdatedPerSecond = rates.of("INNODB_ROWS_UPDATED")
+	status.Metrics.RowsDeletedPerSecond = rates.of("INNODB_ROWS_DELETED")
+
+	// Reading the next row of a table without an index vs looking rows up by one
+	status.Metrics.HandlerReadRndNextPerSecond = rates.of("HANDLER_READ_RND_NEXT")
+	status.Metrics.HandlerReadKeyPerSecond = rates.of("HANDLER_READ_KEY")
+
+	// Rows examined per query, lots of them means something is scanning tables
+	if status.Metrics.QueriesPerSecond > 0 {
+		status.Metrics.RowsExaminedPerQuery = status.Metrics.RowsReadPerSecond / status.Metrics.QueriesPerSecond
 	}
 
-	return nil
+	status.Metrics.TableScans = status.Metrics.RowsExaminedPerQuery >= tableScanRows
+
+	// Temporary tables and files, the disk ones are the slow ones
+	status.Metrics.TmpTablesPerSecond = rates.of("CREATED_TMP_TABLES")
+	status.Metrics.TmpDiskTablesPerSecond = rates.of("CREATED_TMP_DISK_TABLES")
+	status.Metrics.TmpFilesPerSecond = rates.of("CREATED_TMP_FILES")
+	status.Metrics.DiskTmpTableRatio = rates.ratio("CREATED_TMP_DISK_TABLES", "CREATED_TMP_TABLES")
+
+	// Sorts that didn't fit in sort_buffer_size
+	status.Metrics.SortMergePassesPerSecond = rates.of("SORT_MERGE_PASSES")
+
+	// Joins and selects that didn't use an index
+	status.Metrics.SelectFullJoinPerSecond = rates.of("SELECT_FULL_JOIN")
+	status.Metrics.SelectScanPerSecond = rates.of("SELECT_SCAN")
+
+	// Table locks that had to wait, MyISAM and LOCK TABLES
+	status.Metrics.TableLocksWaitedPerSecond = rates.of("TABLE_LOCKS_WAITED")
+
+	// Load averages
+	var last DatabaseMetrics
+
+	if previous != nil {
+		last = previous.Metrics
+	}
+
+	status.Metrics.QueriesLoad = rates.average(last.QueriesLoad, status.Metrics.QueriesPerSecond)
+	status.Metrics.ReadsLoad = rates.average(last.ReadsLoad, status.Metrics.ReadsPerSecond)
+	status.Metrics.WritesLoad = rates.average(last.WritesLoad, status.Metrics.WritesPerSecond)
+
+	// InnoDB
+	postProcessInnoDB(rates, status)
 }
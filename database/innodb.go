@@ -0,0 +1,58 @@
+// tsadmin/database
+package database
+
+// DatabaseInnoDB is how the InnoDB buffer pool and I/O are doing
+type DatabaseInnoDB struct {
+	BufferPoolHitRatio    float64 `json:"buffer_pool_hit_ratio"`
+	PagesTotal            int     `json:"pages_total"`
+	PagesFree             int     `json:"pages_free"`
+	PagesDirty            int     `json:"pages_dirty"`
+	DirtyPagesPercent     float64 `json:"dirty_pages_percent"`
+	DataReadsPerSecond    float64 `json:"data_reads_per_second"`
+	DataWritesPerSecond   float64 `json:"data_writes_per_second"`
+	DataFsyncsPerSecond   float64 `json:"data_fsyncs_per_second"`
+	LogWritesPerSecond    float64 `json:"log_writes_per_second"`
+	LogWaitsPerSecond     float64 `json:"log_waits_per_second"`
+	PendingReads          int     `json:"pending_reads"`
+	PendingWrites         int     `json:"pending_writes"`
+	PendingFsyncs         int     `json:"pending_fsyncs"`
+	RowLockWaitsPerSecond float64 `json:"row_lock_waits_per_second"`
+	RowLockCurrentWaits   int     `json:"row_lock_current_waits"`
+	RowLockTimeAvg        int     `json:"row_lock_time_avg"`
+}
+
+// Work out the InnoDB metrics from the status counters
+func postProcessInnoDB(rates *rates, status *DatabaseStatus) {
+	counters := status.Metrics.counters
+	innodb := &status.InnoDB
+
+	// Buffer pool pages
+	innodb.PagesTotal = int(counters["INNODB_BUFFER_POOL_PAGES_TOTAL"])
+	innodb.PagesFree = int(counters["INNODB_BUFFER_POOL_PAGES_FREE"])
+	innodb.PagesDirty = int(counters["INNODB_BUFFER_POOL_PAGES_DIRTY"])
+
+	if innodb.PagesTotal > 0 {
+		innodb.DirtyPagesPercent = float64(innodb.PagesDirty) / float64(innodb.PagesTotal) * 100
+	}
+
+	// Buffer pool hit ratio, reads are the requests that had to go to disk so
+	// if there were no requests at all then nothing missed
+	innodb.BufferPoolHitRatio = 1 - rates.ratio("INNODB_BUFFER_POOL_READS", "INNODB_BUFFER_POOL_READ_REQUESTS")
+
+	// Data and log I/O per second
+	innodb.DataReadsPerSecond = rates.of("INNODB_DATA_READS")
+	innodb.DataWritesPerSecond = rates.of("INNODB_DATA_WRITES")
+	innodb.DataFsyncsPerSecond = rates.of("INNODB_DATA_FSYNCS")
+	innodb.LogWritesPerSecond = rates.of("INNODB_LOG_WRITES")
+	innodb.LogWaitsPerSecond = rates.of("INNODB_LOG_WAITS")
+
+	// I/O that is waiting to happen
+	innodb.PendingReads = int(counters["INNODB_DATA_PENDING_READS"])
+	innodb.PendingWrites = int(counters["INNODB_DATA_PENDING_WRITES"])
+	innodb.PendingFsyncs = int(counters["INNODB_DATA_PENDING_FSYNCS"])
+
+	// Row lock waits, the average time is in milliseconds
+	innodb.RowLockWaitsPerSecond = rates.of("INNODB_ROW_LOCK_WAITS")
+	innodb.RowLockCurrentWaits = int(counters["INNODB_ROW_LOCK_CURRENT_WAITS"])
+	innodb.RowLockTimeAvg = int(counters["INNODB_ROW_LOCK_TIME_AVG"])
+}
@@ -0,0 +1,84 @@
+// tsadmin/database
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// What a thread can be killed with
+const (
+	KillQuery      = "query"
+	KillConnection = "connection"
+)
+
+// Reasons we refuse to kill a thread
+var (
+	ErrThreadGone   = errors.New("the thread has already finished")
+	ErrQueryChanged = errors.New("the thread is running a different query now")
+)
+
+// Kill stops the query a thread is running, or closes its connection altogether.
+// The thread is only killed if it's still running the query with the given hash
+// so we don't kill whatever it moved on to while someone was deciding. The
+// process is returned as it was just before it was killed.
+func Kill(ctx context.Context, pool *Pool, db Database, id int64, queryHash string, mode string) (*Process, error) {
+	if mode != KillQuery && mode != KillConnection {
+		return nil, fmt.Errorf("threads can be killed with query or connection, not %q", mode)
+	}
+
+	pooled, err := pool.Get(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Check and kill on the same connection so nothing else slips in between
+	conn, err := pooled.Conn(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	row := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT %s FROM information_schema.PROCESSLIST WHERE ID = ?", processColumns), id)
+	process, err := scanProcess(row)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrThreadGone
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if process.QueryHash != queryHash {
+		return process, ErrQueryChanged
+	}
+
+	// KILL doesn't take placeholders but the ID is a number so this is safe
+	kill := "KILL QUERY"
+
+	if mode == KillConnection {
+		kill = "KILL CONNECTION"
+	}
+
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("%s %d", kill, id)); err != nil {
+		return process, err
+	}
+
+	return process, nil
+}
+
+// A short hash of the full text of a query, used to tell whether a thread is
+// still running the query we saw earlier
+func hashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+
+	return hex.EncodeToString(sum[:8])
+}
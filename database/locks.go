@@ -0,0 +1,179 @@
+// tsadmin/database
+package database
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Lock is the lock a thread is waiting for
+type Lock struct {
+	Table string `json:"table"`
+	Index string `json:"index,omitempty"`
+	Type  string `json:"type"`
+	Mode  string `json:"mode"`
+}
+
+// LockThread is a thread in the lock-wait graph, along with the threads that
+// are waiting on it
+type LockThread struct {
+	Process
+	WaitingFor *Lock         `json:"waiting_for,omitempty"`
+	Blocking   []*LockThread `json:"blocking"`
+}
+
+// A thread waiting on a lock another thread holds
+type lockWait struct {
+	waiting  int64
+	blocking int64
+	lock     Lock
+}
+
+// LockWaits looks up which threads are waiting on InnoDB locks held by other
+// threads and returns them as a tree. Each root is a thread that is holding
+// everyone up without waiting on anyone itself, the threads that have been
+// blocking the longest come first.
+func LockWaits(ctx context.Context, pool *Pool, db Database) ([]*LockThread, error) {
+	conn, err := pool.Get(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := pool.Server(ctx, db, conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, server.lockWaitsQuery())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	waits := []lockWait{}
+
+	for rows.Next() {
+		var wait lockWait
+
+		if err := rows.Scan(&wait.waiting, &wait.blocking, &wait.lock.Table, &wait.lock.Index, &wait.lock.Type, &wait.lock.Mode); err != nil {
+			return nil, err
+		}
+
+		// Older versions quote the table like `schema`.`table`
+		wait.lock.Table = strings.Replace(wait.lock.Table, "`", "", -1)
+		waits = append(waits, wait)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(waits) == 0 {
+		return []*LockThread{}, nil
+	}
+
+	// Fill in who the threads are and what they're running
+	processes, err := Processlist(ctx, pool, db, ProcessFilter{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lockTree(waits, processes), nil
+}
+
+// Build the blocking tree from the waits
+func lockTree(waits []lockWait, processes []Process) []*LockThread {
+	byID := make(map[int64]Process)
+
+	for _, process := range processes {
+		byID[process.ID] = process
+	}
+
+	// The thread may have finished since we looked at the locks
+	process := func(id int64) Process {
+		if process, ok := byID[id]; ok {
+			return process
+		}
+
+		return Process{ID: id}
+	}
+
+	blocked := make(map[int64][]lockWait)
+	waiting := make(map[int64]bool)
+	blockers := []int64{}
+
+	for _, wait := range waits {
+		if _, ok := blocked[wait.blocking]; !ok {
+			blockers = append(blockers, wait.blocking)
+		}
+
+		blocked[wait.blocking] = append(blocked[wait.blocking], wait)
+		waiting[wait.waiting] = true
+	}
+
+	var build func(id int64, lock *Lock, path map[int64]bool) *LockThread
+
+	build = func(id int64, lock *Lock, path map[int64]bool) *LockThread {
+		thread := &LockThread{Process: process(id), WaitingFor: lock, Blocking: []*LockThread{}}
+
+		// InnoDB breaks deadlocks on its own but we might catch one before it does
+		if path[id] {
+			return thread
+		}
+
+		path[id] = true
+		defer delete(path, id)
+
+		for _, wait := range blocked[id] {
+			lock := wait.lock
+			thread.Blocking = append(thread.Blocking, build(wait.waiting, &lock, path))
+		}
+
+		sortLockThreads(thread.Blocking)
+
+		return thread
+	}
+
+	roots := []*LockThread{}
+
+	for _, id := range blockers {
+		if !waiting[id] {
+			roots = append(roots, build(id, nil, make(map[int64]bool)))
+		}
+	}
+
+	// Threads that only block each other are in a deadlock, show them anyway
+	for _, id := range blockers {
+		if waiting[id] && !reachable(id, roots) {
+			roots = append(roots, build(id, nil, make(map[int64]bool)))
+		}
+	}
+
+	sortLockThreads(roots)
+
+	return roots
+}
+
+// Whether the thread is somewhere in the trees
+func reachable(id int64, threads []*LockThread) bool {
+	for _, thread := range threads {
+		if thread.ID == id || reachable(id, thread.Blocking) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The longest running first
+func sortLockThreads(threads []*LockThread) {
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].Time > threads[j].Time
+	})
+}
@@ -0,0 +1,193 @@
+// tsadmin/database
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits for the connections we hold open to each database
+const (
+	maxOpenConnections = 3
+	maxIdleConnections = 2
+	maxConnectionAge   = 10 * time.Minute
+	maxBackoff         = 30 * time.Second
+)
+
+// Pool holds a long lived connection pool for each database we monitor
+type Pool struct {
+	mutex       sync.Mutex
+	connections map[string]*connection
+	timeout     time.Duration
+}
+
+type connection struct {
+	dsn      string
+	db       *sql.DB
+	server   *Server
+	failures int
+	retryAt  time.Time
+}
+
+// BackoffError is returned when a database has failed recently and we are
+// waiting a while before trying it again
+type BackoffError struct {
+	Failures int
+	RetryAt  time.Time
+}
+
+func (e *BackoffError) Error() string {
+	return fmt.Sprintf("backing off after %d failures, retrying at %s", e.Failures, e.RetryAt.Format(time.RFC3339))
+}
+
+func NewPool() *Pool {
+	return &Pool{
+		connections: make(map[string]*connection),
+	}
+}
+
+// NewPoolWithTimeout returns a pool whose connections give up after the timeout
+// rather than the timeout of each database. The driver ignores contexts once it
+// is waiting on the server so queries that take longer than the regular checks
+// need a pool of their own.
+func NewPoolWithTimeout(timeout time.Duration) *Pool {
+	pool := NewPool()
+	pool.timeout = timeout
+
+	return pool
+}
+
+// Get the connection pool for the given database, it's created the first time we
+// see the database and then rebuilt whenever its config changes
+func (p *Pool) Get(db Database) (*sql.DB, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.timeout > 0 {
+		db.Timeout = p.timeout
+	}
+
+	dsn := db.dsn()
+	conn, ok := p.connections[db.Name]
+
+	// The config has changed so throw away the old connections
+	if ok && conn.dsn != dsn {
+		conn.db.Close()
+		ok = false
+	}
+
+	if !ok {
+		pool, err := sql.Open("mysql", dsn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool.SetMaxOpenConns(maxOpenConnections)
+		pool.SetMaxIdleConns(maxIdleConnections)
+		pool.SetConnMaxLifetime(maxConnectionAge)
+
+		conn = &connection{dsn: dsn, db: pool}
+		p.connections[db.Name] = conn
+	}
+
+	// Don't hammer a database that is down
+	if time.Now().Before(conn.retryAt) {
+		return nil, &BackoffError{Failures: conn.failures, RetryAt: conn.retryAt}
+	}
+
+	return conn.db, nil
+}
+
+// Get the flavor and version of the given database, this is only looked up once
+// per connection pool and then again whenever the database has been unavailable
+func (p *Pool) Server(ctx context.Context, db Database, conn *sql.DB) (*Server, error) {
+	var server *Server
+
+	p.mutex.Lock()
+
+	if cached, ok := p.connections[db.Name]; ok && cached.db == conn {
+		server = cached.server
+	}
+
+	p.mutex.Unlock()
+
+	if server != nil {
+		return server, nil
+	}
+
+	server, err := detectServer(ctx, conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Make sure the pool wasn't rebuilt while we were looking
+	if cached, ok := p.connections[db.Name]; ok && cached.db == conn {
+		cached.server = server
+	}
+
+	return server, nil
+}
+
+// Record that talking to the database failed, each consecutive failure doubles
+// how long we wait before trying again
+func (p *Pool) Failed(db Database) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conn, ok := p.connections[db.Name]
+
+	if !ok {
+		return
+	}
+
+	conn.failures++
+
+	// The server may have been upgraded while it was away
+	conn.server = nil
+
+	backoff := time.Second << uint(conn.failures-1)
+
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+
+	conn.retryAt = time.Now().Add(backoff)
+}
+
+// Record that talking to the database worked
+func (p *Pool) Succeeded(db Database) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if conn, ok := p.connections[db.Name]; ok {
+		conn.failures = 0
+		conn.retryAt = time.Time{}
+	}
+}
+
+// Close the connections of any database that is no longer in the given list
+func (p *Pool) Retain(dbs []Database) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	keep := make(map[string]bool)
+
+	for _, db := range dbs {
+		keep[db.Name] = true
+	}
+
+	for name, conn := range p.connections {
+		if !keep[name] {
+			conn.db.Close()
+			delete(p.connections, name)
+		}
+	}
+}
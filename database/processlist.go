@@ -0,0 +1,167 @@
+// tsadmin/database
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Queries longer than this are cut short, the full text of a big INSERT isn't much use
+const maxQueryLength = 512
+
+// What we read from the processlist about each thread
+const processColumns = "ID, USER, HOST, DB, COMMAND, TIME, STATE, INFO"
+
+// The columns the processlist can be sorted by
+var processSortColumns = map[string]string{
+	"id":      "ID",
+	"user":    "USER",
+	"host":    "HOST",
+	"db":      "DB",
+	"command": "COMMAND",
+	"time":    "TIME",
+	"state":   "STATE",
+}
+
+// Process is a thread running on the server, as in SHOW FULL PROCESSLIST
+type Process struct {
+	ID        int64  `json:"id"`
+	User      string `json:"user"`
+	Host      string `json:"host"`
+	DB        string `json:"db"`
+	Command   string `json:"command"`
+	Time      int64  `json:"time"`
+	State     string `json:"state"`
+	Query     string `json:"query"`
+	QueryHash string `json:"query_hash"`
+	Truncated bool   `json:"truncated"`
+}
+
+// ProcessFilter narrows down and orders the processlist
+type ProcessFilter struct {
+	HideSleep  bool
+	MinTime    int64
+	User       string
+	Sort       string
+	Descending bool
+}
+
+// Validate checks the filter makes sense
+func (f ProcessFilter) Validate() error {
+	if _, ok := processSortColumns[f.Sort]; f.Sort != "" && !ok {
+		return fmt.Errorf("can't sort the processlist by %s", f.Sort)
+	}
+
+	if f.MinTime < 0 {
+		return fmt.Errorf("min_time can't be negative")
+	}
+
+	return nil
+}
+
+// Processlist looks up the threads running on the database, leaving out our own
+func Processlist(ctx context.Context, pool *Pool, db Database, filter ProcessFilter) ([]Process, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	column := "TIME"
+
+	if filter.Sort != "" {
+		column = processSortColumns[filter.Sort]
+	}
+
+	conn, err := pool.Get(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []string{"ID != CONNECTION_ID()"}
+	args := []interface{}{}
+
+	if filter.HideSleep {
+		conditions = append(conditions, "COMMAND != 'Sleep'")
+	}
+
+	if filter.MinTime > 0 {
+		conditions = append(conditions, "TIME >= ?")
+		args = append(args, filter.MinTime)
+	}
+
+	if filter.User != "" {
+		conditions = append(conditions, "USER = ?")
+		args = append(args, filter.User)
+	}
+
+	direction := "ASC"
+
+	if filter.Descending {
+		direction = "DESC"
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM information_schema.PROCESSLIST WHERE %s ORDER BY %s %s, ID",
+		processColumns, strings.Join(conditions, " AND "), column, direction,
+	)
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	processes := []Process{}
+
+	for rows.Next() {
+		process, err := scanProcess(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		processes = append(processes, *process)
+	}
+
+	return processes, rows.Err()
+}
+
+// Read a thread from a row of processColumns
+func scanProcess(row interface {
+	Scan(dest ...interface{}) error
+}) (*Process, error) {
+	var (
+		process                   Process
+		host, schema, state, info sql.NullString
+	)
+
+	if err := row.Scan(&process.ID, &process.User, &host, &schema, &process.Command, &process.Time, &state, &info); err != nil {
+		return nil, err
+	}
+
+	process.Host = host.String
+	process.DB = schema.String
+	process.State = state.String
+	process.QueryHash = hashQuery(info.String)
+	process.Query, process.Truncated = truncate(info.String, maxQueryLength)
+
+	return &process, nil
+}
+
+// Cut the text down to at most length bytes without splitting a character in half
+func truncate(text string, length int) (string, bool) {
+	if len(text) <= length {
+		return text, false
+	}
+
+	for length > 0 && !utf8.RuneStart(text[length]) {
+		length--
+	}
+
+	return text[:length], true
+}
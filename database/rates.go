@@ -0,0 +1,149 @@
+// tsadmin/database
+package database
+
+import (
+	"math"
+	"time"
+)
+
+// LoadAverage is an exponentially weighted moving average of a rate over
+// 1, 5 and 15 minutes, in the same way as the unix load average
+type LoadAverage struct {
+	One     float64 `json:"1m"`
+	Five    float64 `json:"5m"`
+	Fifteen float64 `json:"15m"`
+	primed  bool
+}
+
+// Works out per second rates between two samples of the status counters
+type rates struct {
+	current   map[string]float64
+	previous  map[string]float64
+	elapsed   float64
+	restarted bool
+}
+
+func newRates(previous *DatabaseStatus, status *DatabaseStatus) *rates {
+	r := &rates{current: status.Metrics.counters}
+
+	// Without a previous sample we can't know the rate yet
+	if previous == nil || len(previous.Metrics.counters) == 0 {
+		return r
+	}
+
+	r.previous = previous.Metrics.counters
+	r.elapsed = status.Metrics.sampledAt.Sub(previous.Metrics.sampledAt).Seconds()
+
+	// If the uptime has gone down the server has restarted and all the counters
+	// have started again from 0
+	r.restarted = r.current["UPTIME"] < r.previous["UPTIME"]
+
+	return r
+}
+
+// The combined per second rate of the given counters
+func (r *rates) of(keys ...string) float64 {
+	total := 0.0
+
+	for _, key := range keys {
+		total += r.rate(key)
+	}
+
+	return total
+}
+
+func (r *rates) rate(key string) float64 {
+	current, ok := r.current[key]
+
+	if !ok || r.previous == nil {
+		return 0
+	}
+
+	// After a restart the counter covers the time since the server started
+	if r.restarted {
+		if uptime := r.current["UPTIME"]; uptime > 0 {
+			return current / uptime
+		}
+
+		return 0
+	}
+
+	previous, ok := r.previous[key]
+
+	if !ok || r.elapsed <= 0 {
+		return 0
+	}
+
+	diff := current - previous
+
+	// Counters can also be reset by FLUSH STATUS, in which case they started
+	// again from 0 at some point since the previous sample
+	if diff < 0 {
+		diff = current
+	}
+
+	return diff / r.elapsed
+}
+
+// The fraction of whole that part made up over the last interval, such as the
+// buffer pool reads that had to go to disk. Until we have an interval we use
+// the totals since the server started, and if whole didn't move at all it's 0.
+func (r *rates) ratio(part string, whole string) float64 {
+	parts, wholes := r.of(part), r.of(whole)
+
+	if r.previous == nil {
+		parts, wholes = r.current[part], r.current[whole]
+	}
+
+	if wholes <= 0 {
+		return 0
+	}
+
+	return math.Min(parts/wholes, 1)
+}
+
+// Update the load average with the latest rate
+func (r *rates) average(previous LoadAverage, rate float64) LoadAverage {
+	// The rate isn't known yet so there is nothing to average
+	if r.previous == nil || r.elapsed <= 0 {
+		return previous
+	}
+
+	if !previous.primed {
+		return LoadAverage{One: rate, Five: rate, Fifteen: rate, primed: true}
+	}
+
+	return LoadAverage{
+		One:     decay(previous.One, rate, r.elapsed, time.Minute),
+		Five:    decay(previous.Five, rate, r.elapsed, 5*time.Minute),
+		Fifteen: decay(previous.Fifteen, rate, r.elapsed, 15*time.Minute),
+		primed:  true,
+	}
+}
+
+func decay(average float64, rate float64, elapsed float64, window time.Duration) float64 {
+	alpha := 1 - math.Exp(-elapsed/window.Seconds())
+
+	return average + alpha*(rate-average)
+}
+
+// The parts of the metrics we need to work out the next set of rates, this is
+// what we carry over when we fail to collect the metrics
+func (m DatabaseMetrics) baseline() DatabaseMetrics {
+	return DatabaseMetrics{
+		counters:  m.counters,
+		sampledAt: m.sampledAt,
+	}
+}
+
+// GlobalStatus returns the numbers from SHOW GLOBAL STATUS as the server gave
+// them to us, keyed by their upper case names
+func (m DatabaseMetrics) GlobalStatus() map[string]float64 {
+	status := make(map[string]float64, len(m.counters))
+
+	for key, value := range m.counters {
+		status[key] = value
+	}
+
+	return status
+}
@@ -0,0 +1,127 @@
+// tsadmin/database
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error returned when the user is missing the REPLICATION CLIENT privilege
+const errSpecificAccessDenied = 1227
+
+type DatabaseReplication struct {
+	Replica             bool   `json:"replica"`
+	SecondsBehindMaster *int   `json:"seconds_behind_master"`
+	IORunning           string `json:"io_running"`
+	SQLRunning          string `json:"sql_running"`
+	LastIOError         string `json:"last_io_error"`
+	LastSQLError        string `json:"last_sql_error"`
+	RelayLogSpace       int64  `json:"relay_log_space"`
+	MasterHost          string `json:"master_host"`
+	MasterPort          int    `json:"master_port"`
+	MasterServerID      int    `json:"master_server_id"`
+	MasterUUID          string `json:"master_uuid"`
+}
+
+// Look up the replication status of the given database, if it isn't a replica
+// then the returned status will simply have Replica set to false
+func execReplicationQuery(ctx context.Context, conn *sql.DB, server *Server, status *DatabaseStatus) error {
+	rows, err := conn.QueryContext(ctx, server.replicationQuery())
+
+	// Without the REPLICATION CLIENT privilege we just can't tell, that shouldn't
+	// stop us reporting on everything else though
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == errSpecificAccessDenied {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+
+	if err != nil {
+		return err
+	}
+
+	// No rows means this database isn't replicating from anywhere, with multi-source
+	// replication there may be more than one row but we only report the first channel
+	if !rows.Next() {
+		return rows.Err()
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	pointers := make([]interface{}, len(columns))
+
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	if err := rows.Scan(pointers...); err != nil {
+		return err
+	}
+
+	status.Replication.Replica = true
+
+	for i, column := range columns {
+		err = processReplicationColumn(status, column, values[i])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Process a column returned from SHOW SLAVE/REPLICA STATUS
+func processReplicationColumn(status *DatabaseStatus, column string, value sql.RawBytes) error {
+	var err error
+
+	// SHOW REPLICA STATUS uses Source/Replica where SHOW SLAVE STATUS used Master/Slave
+	column = strings.Replace(column, "Source", "Master", -1)
+	column = strings.Replace(column, "Replica", "Slave", -1)
+
+	switch column {
+	// Replication lag, this is NULL when the SQL thread isn't running
+	case "Seconds_Behind_Master":
+		if value != nil {
+			var lag int
+			lag, err = strconv.Atoi(string(value))
+			status.Replication.SecondsBehindMaster = &lag
+		}
+	// Thread states, either Yes, No or Connecting
+	case "Slave_IO_Running":
+		status.Replication.IORunning = string(value)
+	case "Slave_SQL_Running":
+		status.Replication.SQLRunning = string(value)
+	// Errors
+	case "Last_IO_Error":
+		status.Replication.LastIOError = string(value)
+	case "Last_SQL_Error":
+		status.Replication.LastSQLError = string(value)
+	// Relay log size
+	case "Relay_Log_Space":
+		status.Replication.RelayLogSpace, err = strconv.ParseInt(string(value), 10, 64)
+	// Where we are replicating from
+	case "Master_Host":
+		status.Replication.MasterHost = string(value)
+	case "Master_Port":
+		status.Replication.MasterPort, err = strconv.Atoi(string(value))
+	// Identity of the server we are replicating from
+	case "Master_Server_Id":
+		if len(value) > 0 {
+			status.Replication.MasterServerID, err = strconv.Atoi(string(value))
+		}
+	case "Master_UUID":
+		status.Replication.MasterUUID = string(value)
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+// tsadmin/database
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The flavors of MySQL we know how to monitor
+const (
+	FlavorMySQL   = "mysql"
+	FlavorPercona = "percona"
+	FlavorMariaDB = "mariadb"
+)
+
+// Server describes the flavor and version of a database server, this decides
+// where we read the status and variables from
+type Server struct {
+	Flavor  string
+	Version string
+	major   int
+	minor   int
+	patch   int
+}
+
+// Look up the flavor and version of the server
+func detectServer(ctx context.Context, conn *sql.DB) (*Server, error) {
+	var version, comment string
+
+	err := conn.QueryRowContext(ctx, "SELECT VERSION(), @@version_comment").Scan(&version, &comment)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{Flavor: FlavorMySQL, Version: version}
+
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		server.Flavor = FlavorMariaDB
+	} else if strings.Contains(strings.ToLower(comment), "percona") {
+		server.Flavor = FlavorPercona
+	}
+
+	// Versions look like 5.7.22-log or 10.3.8-MariaDB-1:10.3.8+maria~jessie
+	numbers := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3)
+	parts := []*int{&server.major, &server.minor, &server.patch}
+
+	for i := range numbers {
+		*parts[i], _ = strconv.Atoi(numbers[i])
+	}
+
+	return server, nil
+}
+
+// Whether the server is at least the given version
+func (s *Server) atLeast(major int, minor int, patch int) bool {
+	if s.major != major {
+		return s.major > major
+	}
+
+	if s.minor != minor {
+		return s.minor > minor
+	}
+
+	return s.patch >= patch
+}
+
+// The query to read the global status or variables from, MySQL 5.7 moved them to
+// performance_schema and 8.0 removed them from information_schema entirely
+func (s *Server) globalsQuery(queryType string) (string, error) {
+	var table string
+
+	if queryType == "metrics" {
+		table = "GLOBAL_STATUS"
+	} else if queryType == "variables" {
+		table = "GLOBAL_VARIABLES"
+	} else {
+		return "", fmt.Errorf("unknown query type %s", queryType)
+	}
+
+	schema := "information_schema"
+
+	if s.Flavor != FlavorMariaDB && s.atLeast(5, 7, 0) {
+		schema = "performance_schema"
+	}
+
+	return fmt.Sprintf("SELECT VARIABLE_NAME AS 'key', VARIABLE_VALUE AS 'value' FROM %s.%s", schema, table), nil
+}
+
+// The query to fall back to if the performance_schema tables are empty, which is
+// the case when the server is running with performance_schema = OFF
+func (s *Server) fallbackGlobalsQuery(queryType string) string {
+	if queryType == "metrics" {
+		return "SHOW GLOBAL STATUS"
+	}
+
+	return "SHOW GLOBAL VARIABLES"
+}
+
+// The query to look up the replication status with, MySQL 8.0.22 and MariaDB
+// 10.5.1 renamed SHOW SLAVE STATUS and MySQL 8.4 dropped the old name entirely
+func (s *Server) replicationQuery() string {
+	if s.Flavor == FlavorMariaDB && s.atLeast(10, 5, 1) {
+		return "SHOW REPLICA STATUS"
+	}
+
+	if s.Flavor != FlavorMariaDB && s.atLeast(8, 0, 22) {
+		return "SHOW REPLICA STATUS"
+	}
+
+	return "SHOW SLAVE STATUS"
+}
+
+// The query to look up which threads are waiting on InnoDB locks held by which
+// others. MySQL 8.0 replaced INNODB_LOCK_WAITS with performance_schema tables
+// that know about threads rather than transactions. The sys schema wraps these
+// up in innodb_lock_waits but it isn't always installed so we go to the source.
+func (s *Server) lockWaitsQuery() string {
+	if s.Flavor != FlavorMariaDB && s.atLeast(8, 0, 1) {
+		return `
+			SELECT rt.PROCESSLIST_ID, bt.PROCESSLIST_ID,
+				CONCAT(IFNULL(l.OBJECT_SCHEMA, ''), '.', IFNULL(l.OBJECT_NAME, '')),
+				IFNULL(l.INDEX_NAME, ''), l.LOCK_TYPE, l.LOCK_MODE
+			FROM performance_schema.data_lock_waits w
+			JOIN performance_schema.data_locks l
+				ON l.ENGINE = w.ENGINE AND l.ENGINE_LOCK_ID = w.REQUESTING_ENGINE_LOCK_ID
+			JOIN performance_schema.threads rt ON rt.THREAD_ID = w.REQUESTING_THREAD_ID
+			JOIN performance_schema.threads bt ON bt.THREAD_ID = w.BLOCKING_THREAD_ID
+			WHERE rt.PROCESSLIST_ID IS NOT NULL AND bt.PROCESSLIST_ID IS NOT NULL`
+	}
+
+	return `
+		SELECT r.trx_mysql_thread_id, b.trx_mysql_thread_id,
+			l.lock_table,
+			IFNULL(l.lock_index, ''), l.lock_type, l.lock_mode
+		FROM information_schema.INNODB_LOCK_WAITS w
+		JOIN information_schema.INNODB_TRX r ON r.trx_id = w.requesting_trx_id
+		JOIN information_schema.INNODB_TRX b ON b.trx_id = w.blocking_trx_id
+		JOIN information_schema.INNODB_LOCKS l ON l.lock_id = w.requested_lock_id`
+}
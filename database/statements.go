@@ -0,0 +1,58 @@
+// tsadmin/database
+package database
+
+import (
+	"context"
+)
+
+// StatementTotals is a row of events_statements_summary_by_digest, everything in
+// it is a running total since the server started or the table was truncated
+type StatementTotals struct {
+	Schema       string
+	Digest       string
+	Text         string
+	Count        uint64
+	TimerWait    uint64
+	RowsExamined uint64
+	RowsSent     uint64
+}
+
+// Statements reads the statement digest summary from performance_schema. It's
+// empty if performance_schema is turned off.
+func Statements(ctx context.Context, pool *Pool, db Database) ([]StatementTotals, error) {
+	conn, err := pool.Get(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `
+		SELECT IFNULL(SCHEMA_NAME, ''), IFNULL(DIGEST, ''), IFNULL(DIGEST_TEXT, ''),
+			COUNT_STAR, SUM_TIMER_WAIT, SUM_ROWS_EXAMINED, SUM_ROWS_SENT
+		FROM performance_schema.events_statements_summary_by_digest`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	statements := []StatementTotals{}
+
+	for rows.Next() {
+		var statement StatementTotals
+
+		err := rows.Scan(
+			&statement.Schema, &statement.Digest, &statement.Text,
+			&statement.Count, &statement.TimerWait, &statement.RowsExamined, &statement.RowsSent,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		statements = append(statements, statement)
+	}
+
+	return statements, rows.Err()
+}
@@ -0,0 +1,93 @@
+// tsadmin/database
+package database
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Values returns every number in the status keyed by its JSON name, this is what
+// the history and alerting work from. Load averages are keyed by their window,
+// for example queries_load_1m, and InnoDB values start with innodb_. If the
+// status failed only up, collection_duration and consecutive_failures are
+// included.
+func (s *DatabaseStatus) Values() map[string]float64 {
+	values := map[string]float64{
+		"up":                   0,
+		"collection_duration":  s.CollectionDuration,
+		"consecutive_failures": float64(s.ConsecutiveFailures),
+	}
+
+	// Everything else is unknown when we couldn't reach the database
+	if s.State != StateOK {
+		return values
+	}
+
+	values["up"] = 1
+
+	addValues(values, "", reflect.ValueOf(s.Metrics))
+	addValues(values, "", reflect.ValueOf(s.Variables))
+	addValues(values, "", reflect.ValueOf(s.Replication))
+	addValues(values, "innodb_", reflect.ValueOf(s.InnoDB))
+
+	// The replication threads are Yes/No/Connecting, only Yes counts as running
+	if s.Replication.Replica {
+		values["io_running"] = 0
+		values["sql_running"] = 0
+
+		if s.Replication.IORunning == "Yes" {
+			values["io_running"] = 1
+		}
+
+		if s.Replication.SQLRunning == "Yes" {
+			values["sql_running"] = 1
+		}
+	}
+
+	return values
+}
+
+// Add the numbers in the struct, prefixing their names with prefix
+func addValues(values map[string]float64, prefix string, value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		// Skip unexported fields
+		if field.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+
+		name = prefix + name
+
+		fieldValue := value.Field(i)
+
+		// Unknown values such as the lag of a stopped replica are left out
+		if fieldValue.Kind() == reflect.Ptr {
+			if fieldValue.IsNil() {
+				continue
+			}
+
+			fieldValue = fieldValue.Elem()
+		}
+
+		switch fieldValue.Kind() {
+		case reflect.Int, reflect.Int64:
+			values[name] = float64(fieldValue.Int())
+		case reflect.Float64:
+			values[name] = fieldValue.Float()
+		case reflect.Bool:
+			values[name] = 0
+
+			if fieldValue.Bool() {
+				values[name] = 1
+			}
+		case reflect.Struct:
+			if load, ok := fieldValue.Interface().(LoadAverage); ok {
+				values[name+"_1m"] = load.One
+				values[name+"_5m"] = load.Five
+				values[name+"_15m"] = load.Fifteen
+			}
+		}
+	}
+}
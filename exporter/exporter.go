@@ -0,0 +1,340 @@
+// tsadmin/exporter
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+const namespace = "tsadmin"
+
+// The global status values that say how things are right now
+var statusGauges = map[string]bool{
+	"DELAYED_INSERT_THREADS":                 true,
+	"INNODB_BUFFER_POOL_BYTES_DATA":          true,
+	"INNODB_BUFFER_POOL_BYTES_DIRTY":         true,
+	"INNODB_BUFFER_POOL_BYTES_MISC":          true,
+	"INNODB_BUFFER_POOL_PAGES_DATA":          true,
+	"INNODB_BUFFER_POOL_PAGES_DIRTY":         true,
+	"INNODB_BUFFER_POOL_PAGES_FREE":          true,
+	"INNODB_BUFFER_POOL_PAGES_LATCHED":       true,
+	"INNODB_BUFFER_POOL_PAGES_MISC":          true,
+	"INNODB_BUFFER_POOL_PAGES_OLD":           true,
+	"INNODB_BUFFER_POOL_PAGES_TOTAL":         true,
+	"INNODB_CHECKPOINT_AGE":                  true,
+	"INNODB_CHECKPOINT_MAX_AGE":              true,
+	"INNODB_DATA_PENDING_FSYNCS":             true,
+	"INNODB_DATA_PENDING_READS":              true,
+	"INNODB_DATA_PENDING_WRITES":             true,
+	"INNODB_HISTORY_LIST_LENGTH":             true,
+	"INNODB_MEM_ADAPTIVE_HASH":               true,
+	"INNODB_MEM_DICTIONARY":                  true,
+	"INNODB_MEM_TOTAL":                       true,
+	"INNODB_NUM_OPEN_FILES":                  true,
+	"INNODB_OS_LOG_PENDING_FSYNCS":           true,
+	"INNODB_OS_LOG_PENDING_WRITES":           true,
+	"INNODB_PAGE_SIZE":                       true,
+	"INNODB_ROW_LOCK_CURRENT_WAITS":          true,
+	"INNODB_ROW_LOCK_TIME_AVG":               true,
+	"INNODB_ROW_LOCK_TIME_MAX":               true,
+	"INNODB_UNDO_TABLESPACES_ACTIVE":         true,
+	"INNODB_UNDO_TABLESPACES_TOTAL":          true,
+	"KEY_BLOCKS_NOT_FLUSHED":                 true,
+	"KEY_BLOCKS_UNUSED":                      true,
+	"KEY_BLOCKS_USED":                        true,
+	"LAST_QUERY_COST":                        true,
+	"LAST_QUERY_PARTIAL_PLANS":               true,
+	"MAX_USED_CONNECTIONS":                   true,
+	"MEMORY_USED":                            true,
+	"MEMORY_USED_INITIAL":                    true,
+	"NOT_FLUSHED_DELAYED_ROWS":               true,
+	"OPEN_FILES":                             true,
+	"OPEN_STREAMS":                           true,
+	"OPEN_TABLES":                            true,
+	"OPEN_TABLE_DEFINITIONS":                 true,
+	"PREPARED_STMT_COUNT":                    true,
+	"QCACHE_FREE_BLOCKS":                     true,
+	"QCACHE_FREE_MEMORY":                     true,
+	"QCACHE_QUERIES_IN_CACHE":                true,
+	"QCACHE_TOTAL_BLOCKS":                    true,
+	"REPLICA_OPEN_TEMP_TABLES":               true,
+	"RPL_SEMI_SYNC_MASTER_CLIENTS":           true,
+	"RPL_SEMI_SYNC_MASTER_NET_AVG_WAIT_TIME": true,
+	"RPL_SEMI_SYNC_MASTER_STATUS":            true,
+	"RPL_SEMI_SYNC_MASTER_TX_AVG_WAIT_TIME":  true,
+	"RPL_SEMI_SYNC_MASTER_WAIT_SESSIONS":     true,
+	"RPL_SEMI_SYNC_REPLICA_STATUS":           true,
+	"RPL_SEMI_SYNC_SLAVE_STATUS":             true,
+	"RPL_SEMI_SYNC_SOURCE_CLIENTS":           true,
+	"RPL_SEMI_SYNC_SOURCE_NET_AVG_WAIT_TIME": true,
+	"RPL_SEMI_SYNC_SOURCE_STATUS":            true,
+	"RPL_SEMI_SYNC_SOURCE_TX_AVG_WAIT_TIME":  true,
+	"RPL_SEMI_SYNC_SOURCE_WAIT_SESSIONS":     true,
+	"SLAVES_CONNECTED":                       true,
+	"SLAVES_RUNNING":                         true,
+	"SLAVE_OPEN_TEMP_TABLES":                 true,
+	"SSL_SESSION_CACHE_SIZE":                 true,
+	"THREADS_CACHED":                         true,
+	"THREADS_CONNECTED":                      true,
+	"THREADS_RUNNING":                        true,
+	"UPTIME":                                 true,
+	"UPTIME_SINCE_FLUSH_STATUS":              true,
+}
+
+// The global status values that only ever go up, until the server restarts or the
+// status is flushed. Anything that is neither a known gauge nor a counter is
+// exported as untyped so rate() doesn't treat every drop as a reset.
+var statusCounters = map[string]bool{
+	"ABORTED_CLIENTS":                   true,
+	"ABORTED_CONNECTS":                  true,
+	"BINLOG_CACHE_DISK_USE":             true,
+	"BINLOG_CACHE_USE":                  true,
+	"BYTES_RECEIVED":                    true,
+	"BYTES_SENT":                        true,
+	"CONNECTIONS":                       true,
+	"CONNECTION_ERRORS_INTERNAL":        true,
+	"CONNECTION_ERRORS_MAX_CONNECTIONS": true,
+	"CREATED_TMP_DISK_TABLES":           true,
+	"CREATED_TMP_FILES":                 true,
+	"CREATED_TMP_TABLES":                true,
+	"FLUSH_COMMANDS":                    true,
+	"QUERIES":                           true,
+	"QUESTIONS":                         true,
+	"SLOW_QUERIES":                      true,
+	"SLOW_LAUNCH_THREADS":               true,
+	"TABLE_LOCKS_IMMEDIATE":             true,
+	"TABLE_LOCKS_WAITED":                true,
+	"THREADS_CREATED":                   true,
+}
+
+// Whole families of counters
+var statusCounterPrefixes = []string{
+	"COM_",
+	"HANDLER_",
+	"SELECT_",
+	"SORT_",
+	"OPENED_",
+	"KEY_READ",
+	"KEY_WRITE",
+	"QCACHE_HITS",
+	"QCACHE_INSERTS",
+	"QCACHE_LOWMEM_PRUNES",
+	"QCACHE_NOT_CACHED",
+	"INNODB_BUFFER_POOL_READ",
+	"INNODB_BUFFER_POOL_WRITE_REQUESTS",
+	"INNODB_BUFFER_POOL_WAIT_FREE",
+	"INNODB_BUFFER_POOL_PAGES_FLUSHED",
+	"INNODB_DATA_",
+	"INNODB_DBLWR_",
+	"INNODB_LOG_",
+	"INNODB_OS_LOG_",
+	"INNODB_PAGES_",
+	"INNODB_ROWS_",
+	"INNODB_ROW_LOCK_",
+	"INNODB_DEADLOCKS",
+}
+
+// A metric and all of its samples, in the Prometheus text format all the samples
+// of a metric need to be written together
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples []sample
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+type families struct {
+	byName map[string]*family
+	order  []*family
+}
+
+// Write the statuses out in the Prometheus text exposition format
+func Write(w io.Writer, statuses []*database.DatabaseStatus) error {
+	f := &families{byName: make(map[string]*family)}
+
+	for _, status := range statuses {
+		labels := hostLabels(status)
+
+		// How the collection went
+		f.add("up", "Whether the last collection from the database succeeded.", "gauge", labels, boolValue(status.State == database.StateOK))
+		f.add("collection_duration_seconds", "How long the last collection from the database took.", "gauge", labels, status.CollectionDuration)
+		f.add("consecutive_failures", "How many collections in a row have failed.", "gauge", labels, float64(status.ConsecutiveFailures))
+
+		if status.LastSuccess != nil {
+			f.add("last_success_timestamp_seconds", "When the database was last collected from successfully.", "gauge", labels, float64(status.LastSuccess.UnixNano())/1e9)
+		}
+
+		// Everything else would just be zeroes
+		if status.State != database.StateOK {
+			continue
+		}
+
+		f.add("mysql_info", "Information about the database server.", "gauge", labels+label("flavor", status.Metadata.Flavor)+label("version", status.Metadata.Version)+label("server_uuid", status.Variables.ServerUUID), 1)
+
+		f.addGlobalStatus(labels, status.Metrics.GlobalStatus())
+		f.addStruct("mysql_", labels, reflect.ValueOf(status.Metrics))
+		f.addStruct("mysql_variables_", labels, reflect.ValueOf(status.Variables))
+		f.addReplication(labels, status.Replication)
+		f.addStruct("mysql_innodb_", labels, reflect.ValueOf(status.InnoDB))
+	}
+
+	for _, metric := range f.order {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+
+		for _, sample := range metric.samples {
+			if _, err := fmt.Fprintf(w, "%s{%s} %s\n", metric.name, strings.TrimSuffix(sample.labels, ","), formatValue(sample.value)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *families) add(name string, help string, kind string, labels string, value float64) {
+	name = namespace + "_" + name
+	metric, ok := f.byName[name]
+
+	if !ok {
+		metric = &family{name: name, help: help, kind: kind}
+		f.byName[name] = metric
+		f.order = append(f.order, metric)
+	}
+
+	metric.samples = append(metric.samples, sample{labels: labels, value: value})
+}
+
+// Add the raw global status values so Prometheus can work out its own rates
+func (f *families) addGlobalStatus(labels string, status map[string]float64) {
+	keys := []string{}
+
+	for key := range status {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := "mysql_global_status_" + strings.ToLower(key)
+		kind := statusKind(key)
+
+		if kind == "counter" {
+			name += "_total"
+		}
+
+		f.add(name, fmt.Sprintf("The %s global status value.", key), kind, labels, status[key])
+	}
+}
+
+// Whether the global status value is a gauge, a counter or we don't know, the
+// gauges are checked first as some of them share a prefix with counters
+func statusKind(key string) string {
+	if statusGauges[key] {
+		return "gauge"
+	}
+
+	if statusCounters[key] {
+		return "counter"
+	}
+
+	for _, prefix := range statusCounterPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return "counter"
+		}
+	}
+
+	return "untyped"
+}
+
+// Add every number in the given struct using the names of its JSON fields, these
+// are all worked out by tsadmin at the time so they are gauges
+func (f *families) addStruct(prefix string, labels string, value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		// Skip unexported fields
+		if field.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+
+		kind := "gauge"
+		help := fmt.Sprintf("The %s of the database.", strings.Replace(name, "_", " ", -1))
+		fieldValue := value.Field(i)
+
+		switch fieldValue.Kind() {
+		case reflect.Int, reflect.Int64:
+			f.add(prefix+name, help, kind, labels, float64(fieldValue.Int()))
+		case reflect.Float64:
+			f.add(prefix+name, help, kind, labels, fieldValue.Float())
+		case reflect.Bool:
+			f.add(prefix+name, help, kind, labels, boolValue(fieldValue.Bool()))
+		case reflect.Struct:
+			// Load averages are split out by their window
+			if load, ok := fieldValue.Interface().(database.LoadAverage); ok {
+				f.add(prefix+name, help, kind, labels+label("window", "1m"), load.One)
+				f.add(prefix+name, help, kind, labels+label("window", "5m"), load.Five)
+				f.add(prefix+name, help, kind, labels+label("window", "15m"), load.Fifteen)
+			}
+		}
+	}
+}
+
+func (f *families) addReplication(labels string, replication database.DatabaseReplication) {
+	f.add("mysql_replication_replica", "Whether the database is a replica.", "gauge", labels, boolValue(replication.Replica))
+
+	if !replication.Replica {
+		return
+	}
+
+	f.add("mysql_replication_io_running", "Whether the replication IO thread is running.", "gauge", labels, boolValue(replication.IORunning == "Yes"))
+	f.add("mysql_replication_sql_running", "Whether the replication SQL thread is running.", "gauge", labels, boolValue(replication.SQLRunning == "Yes"))
+	f.add("mysql_replication_relay_log_space_bytes", "The total size of the relay logs.", "gauge", labels, float64(replication.RelayLogSpace))
+
+	// Lag is unknown when the SQL thread isn't running
+	if replication.SecondsBehindMaster != nil {
+		f.add("mysql_replication_seconds_behind_master", "How far behind its master the replica is.", "gauge", labels, float64(*replication.SecondsBehindMaster))
+	}
+}
+
+// The labels identifying the database, these end with a trailing comma which is
+// stripped off when the sample is written
+func hostLabels(status *database.DatabaseStatus) string {
+	return label("name", status.Metadata.Name) +
+		label("host", status.Metadata.Host) +
+		label("port", strconv.Itoa(status.Metadata.Port)) +
+		label("group", status.Metadata.Group)
+}
+
+func label(name string, value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+
+	return fmt.Sprintf(`%s="%s",`, name, value)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
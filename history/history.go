@@ -0,0 +1,198 @@
+// tsadmin/history
+package history
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+// How often we expect a new sample, this decides how big each ring needs to be
+const interval = time.Second
+
+// History keeps the recent values of every database in memory. Only the numbers
+// from each status are kept rather than the whole status as they take up a lot
+// less space.
+type History struct {
+	mutex     sync.RWMutex
+	retention time.Duration
+	rings     map[string]*ring
+}
+
+// Point is the value of a metric at a point in time
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// A fixed size ring buffer of samples for a single database
+type ring struct {
+	columns map[string]int
+	times   []time.Time
+	values  [][]float64
+	next    int
+	size    int
+}
+
+func New(retention time.Duration) *History {
+	return &History{
+		retention: retention,
+		rings:     make(map[string]*ring),
+	}
+}
+
+// Add the latest statuses to the history, anything no longer being monitored
+// is forgotten about
+func (h *History) Add(statuses map[string]*database.DatabaseStatus) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for name, ring := range h.rings {
+		if _, ok := statuses[name]; !ok {
+			delete(h.rings, name)
+		} else if ring.capacity() != h.capacity() {
+			h.rings[name] = ring.resize(h.capacity())
+		}
+	}
+
+	for name, status := range statuses {
+		r, ok := h.rings[name]
+
+		if !ok {
+			r = newRing(h.capacity())
+			h.rings[name] = r
+		}
+
+		r.add(status.CollectedAt, status.Values())
+	}
+}
+
+// Change how long the history is kept for
+func (h *History) SetRetention(retention time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.retention = retention
+}
+
+// Whether we have any history for the given database
+func (h *History) Has(name string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	_, ok := h.rings[name]
+
+	return ok
+}
+
+// The values of the metric for the given database since the given time, oldest first
+func (h *History) Points(name string, metric string, since time.Time) []Point {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	points := []Point{}
+	r, ok := h.rings[name]
+
+	if !ok {
+		return points
+	}
+
+	column, ok := r.columns[metric]
+
+	if !ok {
+		return points
+	}
+
+	cutoff := time.Now().Add(-h.retention)
+
+	if since.Before(cutoff) {
+		since = cutoff
+	}
+
+	r.each(func(at time.Time, values []float64) {
+		if at.Before(since) || column >= len(values) || math.IsNaN(values[column]) {
+			return
+		}
+
+		points = append(points, Point{Time: at, Value: values[column]})
+	})
+
+	return points
+}
+
+func (h *History) capacity() int {
+	return int(h.retention/interval) + 1
+}
+
+func newRing(capacity int) *ring {
+	return &ring{
+		columns: make(map[string]int),
+		times:   make([]time.Time, capacity),
+		values:  make([][]float64, capacity),
+	}
+}
+
+func (r *ring) capacity() int {
+	return len(r.times)
+}
+
+func (r *ring) add(at time.Time, values map[string]float64) {
+	// New metrics can turn up after a server is upgraded, older samples
+	// just won't have a value for them
+	for name := range values {
+		if _, ok := r.columns[name]; !ok {
+			r.columns[name] = len(r.columns)
+		}
+	}
+
+	row := make([]float64, len(r.columns))
+
+	for i := range row {
+		row[i] = math.NaN()
+	}
+
+	for name, value := range values {
+		row[r.columns[name]] = value
+	}
+
+	r.times[r.next] = at
+	r.values[r.next] = row
+	r.next = (r.next + 1) % r.capacity()
+
+	if r.size < r.capacity() {
+		r.size++
+	}
+}
+
+// Call fn with each sample in the ring, oldest first
+func (r *ring) each(fn func(time.Time, []float64)) {
+	start := (r.next - r.size + r.capacity()) % r.capacity()
+
+	for i := 0; i < r.size; i++ {
+		index := (start + i) % r.capacity()
+		fn(r.times[index], r.values[index])
+	}
+}
+
+// Copy the ring into a ring of a different size, keeping the newest samples
+func (r *ring) resize(capacity int) *ring {
+	resized := newRing(capacity)
+	resized.columns = r.columns
+	skip := r.size - capacity
+
+	r.each(func(at time.Time, values []float64) {
+		if skip > 0 {
+			skip--
+			return
+		}
+
+		resized.times[resized.next] = at
+		resized.values[resized.next] = values
+		resized.next = (resized.next + 1) % capacity
+		resized.size++
+	})
+
+	return resized
+}
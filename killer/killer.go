@@ -0,0 +1,382 @@
+// tsadmin/killer
+package killer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/audit"
+	"github.com/jamesrwhite/tsadmin/config"
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+// What a policy can do with the threads it finds
+const (
+	ActionReport         = "report"
+	ActionKillQuery      = "kill-query"
+	ActionKillConnection = "kill-connection"
+)
+
+// What happened to a thread a policy found
+const (
+	ResultReported    = "reported"
+	ResultDryRun      = "dry-run"
+	ResultKilled      = "killed"
+	ResultRateLimited = "rate-limited"
+	ResultFailed      = "failed"
+)
+
+// Threads that keep the server running, like pt-kill we leave these alone
+// unless a policy asks for their user or command by name. Replicas run their
+// threads as system user and primaries run a Binlog Dump thread for each
+// replica, neither of which ever finish so min_time on its own matches them.
+var (
+	systemUsers    = []string{"system user", "event_scheduler"}
+	systemCommands = []string{"Binlog Dump", "Binlog Dump GTID", "Daemon"}
+)
+
+const (
+	// How long we give each database to answer, the killer has its own pool of
+	// connections with this timeout
+	scanTimeout = 5 * time.Second
+	// How many events we keep hold of
+	maxEvents = 1000
+)
+
+// Event is a policy finding a thread, and what it did about it
+type Event struct {
+	Time      time.Time `json:"time"`
+	Policy    string    `json:"policy"`
+	Database  string    `json:"database"`
+	Group     string    `json:"group"`
+	Action    string    `json:"action"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Thread    int64     `json:"thread"`
+	User      string    `json:"user"`
+	DB        string    `json:"db"`
+	Command   string    `json:"command"`
+	Seconds   int64     `json:"seconds"`
+	Query     string    `json:"query"`
+	QueryHash string    `json:"query_hash"`
+}
+
+// Killer applies the kill policies to the processlists of the databases
+type Killer struct {
+	mutex    sync.Mutex
+	pool     *database.Pool
+	audit    *audit.Log
+	seen     map[string]bool
+	limited  map[string]bool
+	kills    map[string][]time.Time
+	events   []Event
+	patterns map[string]*regexp.Regexp
+	invalid  map[string]bool
+}
+
+func New(auditLog *audit.Log) *Killer {
+	return &Killer{
+		pool:     database.NewPoolWithTimeout(scanTimeout),
+		audit:    auditLog,
+		seen:     make(map[string]bool),
+		limited:  make(map[string]bool),
+		kills:    make(map[string][]time.Time),
+		events:   []Event{},
+		patterns: make(map[string]*regexp.Regexp),
+		invalid:  make(map[string]bool),
+	}
+}
+
+// Run the policies against the processlist of each database they apply to
+func (k *Killer) Run(policies []config.KillPolicy, databases []database.Database) {
+	k.pool.Retain(databases)
+
+	seen := make(map[string]bool)
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for _, db := range databases {
+		applicable := []config.KillPolicy{}
+
+		for _, policy := range policies {
+			if applies(policy, db) {
+				applicable = append(applicable, policy)
+			}
+		}
+
+		if len(applicable) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(db database.Database, applicable []config.KillPolicy) {
+			defer wg.Done()
+
+			for _, key := range k.scan(db, applicable) {
+				mutex.Lock()
+				seen[key] = true
+				mutex.Unlock()
+			}
+		}(db, applicable)
+	}
+
+	wg.Wait()
+
+	// Forget about threads that have gone away
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for key := range k.seen {
+		if !seen[key] {
+			delete(k.seen, key)
+		}
+	}
+
+	for key := range k.limited {
+		if !seen[key] {
+			delete(k.limited, key)
+		}
+	}
+}
+
+// Check the processlist of a database against its policies, returning the keys
+// of the threads that matched
+func (k *Killer) scan(db database.Database, policies []config.KillPolicy) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+
+	processes, err := database.Processlist(ctx, k.pool, db, database.ProcessFilter{})
+
+	if err != nil {
+		// The regular checks already log when a database is having trouble
+		return nil
+	}
+
+	keys := []string{}
+
+	for _, process := range processes {
+		for _, policy := range policies {
+			if !k.matches(policy, db, process) {
+				continue
+			}
+
+			key := fmt.Sprintf("%s/%s/%d/%s", policy.Name, db.Name, process.ID, process.QueryHash)
+			keys = append(keys, key)
+
+			// We've already dealt with this one
+			k.mutex.Lock()
+			handled := k.seen[key]
+			k.mutex.Unlock()
+
+			if !handled {
+				k.handle(ctx, key, policy, db, process)
+			}
+
+			// A thread only needs dealing with once
+			break
+		}
+	}
+
+	return keys
+}
+
+// Report or kill a thread that matched a policy. Threads we weren't allowed to
+// kill because of the rate limit are tried again on the next run.
+func (k *Killer) handle(ctx context.Context, key string, policy config.KillPolicy, db database.Database, process database.Process) {
+	now := time.Now()
+	event := Event{
+		Time:      now,
+		Policy:    policy.Name,
+		Database:  db.Name,
+		Group:     db.Group,
+		Action:    policy.Action,
+		Thread:    process.ID,
+		User:      process.User,
+		DB:        process.DB,
+		Command:   process.Command,
+		Seconds:   process.Time,
+		Query:     process.Query,
+		QueryHash: process.QueryHash,
+	}
+
+	switch {
+	case policy.Action == ActionReport:
+		event.Result = ResultReported
+	case policy.DryRun:
+		event.Result = ResultDryRun
+	case !k.allow(policy, now):
+		event.Result = ResultRateLimited
+	default:
+		mode := database.KillQuery
+
+		if policy.Action == ActionKillConnection {
+			mode = database.KillConnection
+		}
+
+		_, err := database.Kill(ctx, k.pool, db, process.ID, process.QueryHash, mode)
+		event.Result = ResultKilled
+
+		if err != nil {
+			event.Result = ResultFailed
+			event.Error = err.Error()
+		}
+
+		k.record(event)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// Only mention being rate limited the first time
+	if event.Result == ResultRateLimited {
+		if k.limited[key] {
+			return
+		}
+
+		k.limited[key] = true
+	} else {
+		k.seen[key] = true
+	}
+
+	log.Printf("Kill policy %s %s thread %d on %s (%s, %ds): %s", policy.Name, event.Result, process.ID, db.Name, process.User, process.Time, process.Query)
+
+	k.events = append(k.events, event)
+
+	if len(k.events) > maxEvents {
+		k.events = k.events[len(k.events)-maxEvents:]
+	}
+}
+
+// Whether the policy is allowed to kill another thread, counting this one if so
+func (k *Killer) allow(policy config.KillPolicy, now time.Time) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	recent := []time.Time{}
+
+	for _, at := range k.kills[policy.Name] {
+		if now.Sub(at) < policy.Per.Duration {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= policy.MaxKills {
+		k.kills[policy.Name] = recent
+		return false
+	}
+
+	k.kills[policy.Name] = append(recent, now)
+
+	return true
+}
+
+// Write the kill to the audit log alongside the ones people do by hand
+func (k *Killer) record(event Event) {
+	entry := audit.Entry{
+		Time:      event.Time,
+		Actor:     "policy:" + event.Policy,
+		Action:    event.Action,
+		Database:  event.Database,
+		Group:     event.Group,
+		Thread:    event.Thread,
+		User:      event.User,
+		Query:     event.Query,
+		QueryHash: event.QueryHash,
+		Result:    audit.ResultOK,
+		Error:     event.Error,
+	}
+
+	if event.Result == ResultFailed {
+		entry.Result = audit.ResultFailed
+	}
+
+	if err := k.audit.Record(entry); err != nil {
+		log.Printf("Error writing to the audit log: %s", err)
+	}
+}
+
+// Events returns the most recent events that match, newest first
+func (k *Killer) Events(limit int, match func(Event) bool) []Event {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	events := []Event{}
+
+	for i := len(k.events) - 1; i >= 0 && (limit <= 0 || len(events) < limit); i-- {
+		if match == nil || match(k.events[i]) {
+			events = append(events, k.events[i])
+		}
+	}
+
+	return events
+}
+
+// Whether the thread matches every rule of the policy
+func (k *Killer) matches(policy config.KillPolicy, db database.Database, process database.Process) bool {
+	if process.Time < int64(policy.MinTime.Seconds()) {
+		return false
+	}
+
+	if !config.Matches(policy.Users, process.User) || !config.Matches(policy.Schemas, process.DB) || !config.Matches(policy.Commands, process.Command) {
+		return false
+	}
+
+	if system(process) && !config.Contains(policy.Users, process.User) && !config.Contains(policy.Commands, process.Command) {
+		return false
+	}
+
+	// Our own connections sit idle in tsadmin's pools between checks, like pt-kill's
+	// --ignore-self we leave them alone unless the policy names our user
+	if process.User == db.User && !config.Contains(policy.Users, process.User) {
+		return false
+	}
+
+	if policy.Match == "" {
+		return true
+	}
+
+	pattern := k.compile(policy.Match)
+
+	return pattern != nil && pattern.MatchString(process.Query)
+}
+
+// Compile the pattern, caching it so we only compile each one once. Invalid
+// patterns are logged the first time we see them and then match nothing.
+func (k *Killer) compile(source string) *regexp.Regexp {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if pattern, ok := k.patterns[source]; ok {
+		return pattern
+	}
+
+	pattern, err := regexp.Compile(source)
+
+	if err != nil {
+		if !k.invalid[source] {
+			log.Printf("Invalid kill policy pattern %q: %s", source, err)
+			k.invalid[source] = true
+		}
+
+		return nil
+	}
+
+	k.patterns[source] = pattern
+
+	return pattern
+}
+
+// Whether the policy covers the database
+func applies(policy config.KillPolicy, db database.Database) bool {
+	return config.Matches(policy.Groups, db.Group) && config.Matches(policy.Databases, db.Name)
+}
+
+// Whether the thread belongs to replication or the server itself
+func system(process database.Process) bool {
+	return config.Contains(systemUsers, process.User) || config.Contains(systemCommands, process.Command)
+}
@@ -0,0 +1,191 @@
+// tsadmin/maintenance
+package maintenance
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Window is a period of time during which a database, or every database in a
+// group, is expected to misbehave and shouldn't be alerted on
+type Window struct {
+	ID        string    `json:"id"`
+	Database  string    `json:"database,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Reason    string    `json:"reason"`
+	Author    string    `json:"author"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Schedule holds the maintenance windows, saving them to a file whenever they change
+type Schedule struct {
+	mutex   sync.RWMutex
+	path    string
+	windows []Window
+}
+
+// Open the schedule saved at the given path, it's fine for it not to exist yet
+func Open(path string) (*Schedule, error) {
+	schedule := &Schedule{path: path, windows: []Window{}}
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return schedule, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &schedule.windows); err != nil {
+		return nil, fmt.Errorf("error reading maintenance windows from %s: %s", path, err)
+	}
+
+	return schedule, nil
+}
+
+// Add a window to the schedule, returning it with its ID filled in
+func (s *Schedule) Add(window Window) (Window, error) {
+	if (window.Database == "") == (window.Group == "") {
+		return window, fmt.Errorf("a window needs either a database or a group")
+	}
+
+	if window.Reason == "" || window.Author == "" {
+		return window, fmt.Errorf("a window needs a reason and an author")
+	}
+
+	if !window.End.After(window.Start) {
+		return window, fmt.Errorf("a window must end after it starts")
+	}
+
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return window, err
+	}
+
+	window.ID = hex.EncodeToString(id)
+	window.CreatedAt = time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.windows = append(s.windows, window)
+
+	return window, s.save()
+}
+
+// Remove the window with the given ID, returning whether there was one
+func (s *Schedule) Remove(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, window := range s.windows {
+		if window.ID == id {
+			s.windows = append(s.windows[:i], s.windows[i+1:]...)
+
+			return true, s.save()
+		}
+	}
+
+	return false, nil
+}
+
+// The window with the given ID, if there is one
+func (s *Schedule) Get(id string) *Window {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, window := range s.windows {
+		if window.ID == id {
+			found := window
+			return &found
+		}
+	}
+
+	return nil
+}
+
+// The windows that haven't ended yet, soonest first
+func (s *Schedule) Windows(now time.Time) []Window {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	windows := []Window{}
+
+	for _, window := range s.windows {
+		if window.End.After(now) {
+			windows = append(windows, window)
+		}
+	}
+
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start.Before(windows[j].Start)
+	})
+
+	return windows
+}
+
+// The window the given database is in at the moment, if any
+func (s *Schedule) Active(database string, group string, now time.Time) *Window {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, window := range s.windows {
+		if now.Before(window.Start) || !now.Before(window.End) {
+			continue
+		}
+
+		if window.Database == database || (window.Group != "" && window.Group == group) {
+			active := window
+			return &active
+		}
+	}
+
+	return nil
+}
+
+// Write the schedule out, dropping windows that are over. It's written to a
+// temporary file first so a crash can't leave us with half a file.
+func (s *Schedule) save() error {
+	now := time.Now()
+	windows := []Window{}
+
+	for _, window := range s.windows {
+		if window.End.After(now) {
+			windows = append(windows, window)
+		}
+	}
+
+	s.windows = windows
+
+	data, err := json.MarshalIndent(windows, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	temporary := s.path + ".tmp"
+
+	if err = ioutil.WriteFile(temporary, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, s.path)
+}
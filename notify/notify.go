@@ -0,0 +1,222 @@
+// tsadmin/notify
+package notify
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/alert"
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+// How many times and how often we try to deliver a notification, the tests
+// shorten the backoff
+const maxAttempts = 5
+
+var (
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+)
+
+// Message is what gets sent to a receiver, a batch of alerts that changed state
+type Message struct {
+	Receiver string        `json:"receiver"`
+	Status   string        `json:"status"`
+	Firing   int           `json:"firing"`
+	Resolved int           `json:"resolved"`
+	Alerts   []alert.Alert `json:"alerts"`
+	Subject  string        `json:"subject"`
+	Text     string        `json:"text"`
+}
+
+// Notifier routes alert transitions to receivers, batching them up so a flapping
+// database doesn't send a message every time it changes state
+type Notifier struct {
+	mutex    sync.Mutex
+	batches  map[string]*batch
+	lastSent map[string]time.Time
+	notified map[string]map[string]bool
+	deliver  func(receiver config.Receiver, message *Message)
+}
+
+type batch struct {
+	started     time.Time
+	transitions map[string]alert.Transition
+}
+
+func New() *Notifier {
+	return &Notifier{
+		batches:  make(map[string]*batch),
+		lastSent: make(map[string]time.Time),
+		notified: make(map[string]map[string]bool),
+		deliver: func(receiver config.Receiver, message *Message) {
+			go deliver(receiver, message)
+		},
+	}
+}
+
+// Queue up the given transitions for the receivers they are routed to and send any
+// batches that are due, this should be called after every check even if nothing changed
+func (n *Notifier) Notify(settings config.NotificationConfig, transitions []alert.Transition, now time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, transition := range transitions {
+		// Nobody needs to hear about alerts that haven't fired yet
+		if transition.To == alert.StatePending {
+			continue
+		}
+
+		for _, receiver := range route(settings.Routes, transition.Alert) {
+			pending, ok := n.batches[receiver]
+
+			if !ok {
+				pending = &batch{started: now, transitions: make(map[string]alert.Transition)}
+				n.batches[receiver] = pending
+			}
+
+			// Only the latest state of each alert matters
+			pending.transitions[key(transition.Alert)] = transition
+		}
+	}
+
+	receivers := make(map[string]config.Receiver)
+
+	for _, receiver := range settings.Receivers {
+		receivers[receiver.Name] = receiver
+	}
+
+	for name, pending := range n.batches {
+		if now.Sub(pending.started) < settings.GroupWait.Duration || now.Sub(n.lastSent[name]) < settings.MinInterval.Duration {
+			continue
+		}
+
+		delete(n.batches, name)
+
+		receiver, ok := receivers[name]
+
+		if !ok {
+			log.Printf("Not sending notifications to unknown receiver %s", name)
+			continue
+		}
+
+		message := n.message(name, pending)
+
+		if message == nil {
+			continue
+		}
+
+		n.lastSent[name] = now
+
+		n.deliver(receiver, message)
+	}
+}
+
+// Turn a batch into a message, alerts that resolved before the receiver heard they
+// were firing are left out and if that leaves nothing there is nothing to send
+func (n *Notifier) message(receiver string, pending *batch) *Message {
+	notified, ok := n.notified[receiver]
+
+	if !ok {
+		notified = make(map[string]bool)
+		n.notified[receiver] = notified
+	}
+
+	message := &Message{Receiver: receiver, Status: alert.StateResolved, Alerts: []alert.Alert{}}
+
+	for key, transition := range pending.transitions {
+		if transition.To == alert.StateResolved {
+			if !notified[key] {
+				continue
+			}
+
+			delete(notified, key)
+			message.Resolved++
+		} else {
+			notified[key] = true
+			message.Firing++
+			message.Status = alert.StateFiring
+		}
+
+		message.Alerts = append(message.Alerts, transition.Alert)
+	}
+
+	if len(message.Alerts) == 0 {
+		return nil
+	}
+
+	sort.Slice(message.Alerts, func(i, j int) bool {
+		a, b := message.Alerts[i], message.Alerts[j]
+
+		if a.State != b.State {
+			return a.State == alert.StateFiring
+		}
+
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+
+		return a.Rule < b.Rule
+	})
+
+	return message
+}
+
+// Send the message, retrying with an increasing delay if it fails
+func deliver(receiver config.Receiver, message *Message) {
+	err := render(receiver, message)
+
+	if err != nil {
+		log.Printf("Error rendering notification for %s: %s", receiver.Name, err)
+		return
+	}
+
+	backoff := initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err = send(receiver, message)
+
+		if err == nil {
+			return
+		}
+
+		if _, permanent := err.(*permanentError); permanent || attempt == maxAttempts {
+			log.Printf("Giving up notifying %s after %d attempts: %s", receiver.Name, attempt, err)
+			return
+		}
+
+		log.Printf("Error notifying %s, retrying in %s: %s", receiver.Name, backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// The receivers of every route that matches the alert
+func route(routes []config.Route, matched alert.Alert) []string {
+	receivers := []string{}
+	seen := make(map[string]bool)
+
+	for _, r := range routes {
+		if !config.Matches(r.Groups, matched.Group) || !config.Matches(r.Databases, matched.Database) || !config.Matches(r.Severities, matched.Severity) {
+			continue
+		}
+
+		if !seen[r.Receiver] {
+			receivers = append(receivers, r.Receiver)
+			seen[r.Receiver] = true
+		}
+	}
+
+	return receivers
+}
+
+func key(a alert.Alert) string {
+	return a.Rule + "/" + a.Database
+}
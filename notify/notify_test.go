@@ -0,0 +1,146 @@
+// tsadmin/notify
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/alert"
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+// A notifier that keeps hold of the messages it would have sent
+func recording() (*Notifier, *[]*Message) {
+	notifier := New()
+	sent := []*Message{}
+
+	notifier.deliver = func(receiver config.Receiver, message *Message) {
+		sent = append(sent, message)
+	}
+
+	return notifier, &sent
+}
+
+func transition(database string, from string, to string) alert.Transition {
+	return alert.Transition{
+		Alert: alert.Alert{Rule: "connections", Database: database, Severity: "critical", State: to},
+		From:  from,
+		To:    to,
+	}
+}
+
+func settings(groupWait time.Duration, minInterval time.Duration) config.NotificationConfig {
+	return config.NotificationConfig{
+		Receivers:   []config.Receiver{{Name: "ops", Type: TypeWebhook}, {Name: "pager", Type: TypeWebhook}},
+		Routes:      []config.Route{{Receiver: "ops"}, {Receiver: "pager", Severities: []string{"page"}}},
+		GroupWait:   config.Duration{Duration: groupWait},
+		MinInterval: config.Duration{Duration: minInterval},
+	}
+}
+
+func TestNotifyGroupWait(t *testing.T) {
+	notifier, sent := recording()
+	s := settings(30*time.Second, 0)
+	start := time.Now()
+
+	notifier.Notify(s, []alert.Transition{transition("db1", alert.StatePending, alert.StateFiring)}, start)
+	notifier.Notify(s, []alert.Transition{transition("db2", alert.StatePending, alert.StateFiring)}, start.Add(10*time.Second))
+
+	if len(*sent) != 0 {
+		t.Fatalf("sent %d messages before group_wait was up", len(*sent))
+	}
+
+	notifier.Notify(s, nil, start.Add(30*time.Second))
+
+	if len(*sent) != 1 {
+		t.Fatalf("sent %d messages after group_wait, want 1", len(*sent))
+	}
+
+	message := (*sent)[0]
+
+	if message.Receiver != "ops" || message.Status != alert.StateFiring || message.Firing != 2 || len(message.Alerts) != 2 {
+		t.Errorf("got message %+v", message)
+	}
+
+	// Nothing was routed to the pager and the alerts are in order
+	if _, ok := notifier.lastSent["pager"]; ok {
+		t.Errorf("sent to the pager")
+	}
+
+	if message.Alerts[0].Database != "db1" || message.Alerts[1].Database != "db2" {
+		t.Errorf("got alerts %+v", message.Alerts)
+	}
+}
+
+func TestNotifyMinInterval(t *testing.T) {
+	notifier, sent := recording()
+	s := settings(0, time.Minute)
+	start := time.Now()
+
+	notifier.Notify(s, []alert.Transition{transition("db1", alert.StatePending, alert.StateFiring)}, start)
+	notifier.Notify(s, []alert.Transition{transition("db2", alert.StatePending, alert.StateFiring)}, start.Add(10*time.Second))
+	notifier.Notify(s, []alert.Transition{transition("db3", alert.StatePending, alert.StateFiring)}, start.Add(20*time.Second))
+
+	if len(*sent) != 1 {
+		t.Fatalf("sent %d messages within min_interval, want 1", len(*sent))
+	}
+
+	notifier.Notify(s, nil, start.Add(time.Minute))
+
+	if len(*sent) != 2 {
+		t.Fatalf("sent %d messages after min_interval, want 2", len(*sent))
+	}
+
+	if second := (*sent)[1]; second.Firing != 2 {
+		t.Errorf("second message has %d firing, want 2", second.Firing)
+	}
+}
+
+func TestNotifyResolved(t *testing.T) {
+	notifier, sent := recording()
+	s := settings(30*time.Second, 0)
+	start := time.Now()
+
+	// Pending alerts are never sent
+	notifier.Notify(s, []alert.Transition{transition("db1", "", alert.StatePending)}, start)
+	notifier.Notify(s, nil, start.Add(time.Minute))
+
+	if len(*sent) != 0 {
+		t.Fatalf("sent %d messages for a pending alert", len(*sent))
+	}
+
+	// Firing and resolving before group_wait is up is dropped
+	notifier.Notify(s, []alert.Transition{transition("db1", alert.StatePending, alert.StateFiring)}, start)
+	notifier.Notify(s, []alert.Transition{transition("db1", alert.StateFiring, alert.StateResolved)}, start.Add(10*time.Second))
+	notifier.Notify(s, nil, start.Add(time.Minute))
+
+	if len(*sent) != 0 {
+		t.Fatalf("sent %d messages for an alert that resolved before anyone heard", len(*sent))
+	}
+
+	// Once somebody has heard it is firing they hear it resolve
+	notifier.Notify(s, []alert.Transition{transition("db1", alert.StatePending, alert.StateFiring)}, start.Add(2*time.Minute))
+	notifier.Notify(s, nil, start.Add(3*time.Minute))
+	notifier.Notify(s, []alert.Transition{transition("db1", alert.StateFiring, alert.StateResolved)}, start.Add(4*time.Minute))
+	notifier.Notify(s, nil, start.Add(5*time.Minute))
+
+	if len(*sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(*sent))
+	}
+
+	if resolved := (*sent)[1]; resolved.Status != alert.StateResolved || resolved.Resolved != 1 || resolved.Firing != 0 {
+		t.Errorf("got message %+v", resolved)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	s := settings(0, 0)
+
+	if receivers := route(s.Routes, alert.Alert{Severity: "critical"}); len(receivers) != 1 || receivers[0] != "ops" {
+		t.Errorf("critical went to %v", receivers)
+	}
+
+	if receivers := route(s.Routes, alert.Alert{Severity: "page"}); len(receivers) != 2 {
+		t.Errorf("page went to %v", receivers)
+	}
+}
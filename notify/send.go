@@ -0,0 +1,175 @@
+// tsadmin/notify
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+// The kinds of receiver we can send to
+const (
+	TypeWebhook = "webhook"
+	TypeSlack   = "slack"
+	TypeEmail   = "email"
+)
+
+const (
+	defaultSubject  = `[tsadmin] {{.Firing}} firing, {{.Resolved}} resolved`
+	defaultTemplate = `{{range .Alerts}}[{{.State}}] {{.Rule}} on {{.Database}}{{if .Group}} ({{.Group}}){{end}}, value {{printf "%g" .Value}}{{if .Description}}: {{.Description}}{{end}}
+{{end}}`
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// An error that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Fill in the subject and text of the message from the receiver's templates
+func render(receiver config.Receiver, message *Message) error {
+	var err error
+
+	message.Subject, err = execute(receiver.Subject, defaultSubject, message)
+
+	if err != nil {
+		return err
+	}
+
+	message.Text, err = execute(receiver.Template, defaultTemplate, message)
+
+	return err
+}
+
+func execute(source string, fallback string, message *Message) (string, error) {
+	if source == "" {
+		source = fallback
+	}
+
+	tmpl, err := template.New("notification").Parse(source)
+
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+
+	if err = tmpl.Execute(&output, message); err != nil {
+		return "", err
+	}
+
+	return output.String(), nil
+}
+
+// Send the message to the receiver
+func send(receiver config.Receiver, message *Message) error {
+	switch receiver.Type {
+	case TypeWebhook:
+		return post(receiver, message)
+	case TypeSlack:
+		return post(receiver, map[string]string{"text": message.Text})
+	case TypeEmail:
+		return email(receiver, message)
+	default:
+		return &permanentError{fmt.Errorf("unknown receiver type %q", receiver.Type)}
+	}
+}
+
+// POST the payload as JSON to the receiver's URL
+func post(receiver config.Receiver, payload interface{}) error {
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	request, err := http.NewRequest("POST", receiver.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	for name, value := range receiver.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	// Read the body so the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 300 {
+		err = fmt.Errorf("%s responded with %s", receiver.URL, response.Status)
+
+		// Anything other than being told to slow down or a server error won't go
+		// away by itself
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return &permanentError{err}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Email the message to the receiver's addresses
+func email(receiver config.Receiver, message *Message) error {
+	if receiver.SMTPHost == "" || receiver.From == "" || len(receiver.To) == 0 {
+		return &permanentError{fmt.Errorf("email receivers need a smtp_host, from and to")}
+	}
+
+	var auth smtp.Auth
+
+	if receiver.Username != "" {
+		host, _, err := net.SplitHostPort(receiver.SMTPHost)
+
+		if err != nil {
+			return &permanentError{err}
+		}
+
+		auth = smtp.PlainAuth("", receiver.Username, receiver.Password, host)
+	}
+
+	headers := []string{
+		"From: " + receiver.From,
+		"To: " + strings.Join(receiver.To, ", "),
+		"Subject: " + headerValue(message.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+
+	body := strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.Replace(message.Text, "\n", "\r\n", -1)
+
+	return smtp.SendMail(receiver.SMTPHost, auth, receiver.From, receiver.To, []byte(body))
+}
+
+// Templates can expand to anything so make sure the value stays on one line,
+// otherwise it could add headers of its own
+func headerValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
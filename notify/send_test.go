@@ -0,0 +1,262 @@
+// tsadmin/notify
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/alert"
+	"github.com/jamesrwhite/tsadmin/config"
+)
+
+func init() {
+	initialBackoff = time.Millisecond
+	maxBackoff = time.Millisecond
+}
+
+func firing() *Message {
+	return &Message{
+		Receiver: "ops",
+		Status:   alert.StateFiring,
+		Firing:   1,
+		Alerts:   []alert.Alert{{Rule: "connections", Database: "db1", State: alert.StateFiring, Value: 95}},
+	}
+}
+
+// An HTTP server that responds with each status in turn and then 200, keeping
+// hold of the bodies it was sent
+type stub struct {
+	mutex    sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (s *stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	s.bodies = append(s.bodies, body)
+	s.headers = append(s.headers, r.Header)
+
+	if len(s.statuses) > 0 {
+		w.WriteHeader(s.statuses[0])
+		s.statuses = s.statuses[1:]
+	}
+}
+
+func (s *stub) attempts() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.bodies)
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{"ok", nil, 1},
+		{"server errors are retried", []int{500, 503}, 3},
+		{"rate limits are retried", []int{429}, 2},
+		{"client errors give up", []int{400}, 1},
+		{"not found gives up", []int{404, 500}, 1},
+		{"gives up after max attempts", []int{500, 500, 500, 500, 500, 500}, maxAttempts},
+	}
+
+	for _, test := range tests {
+		server := &stub{statuses: test.statuses}
+		ts := httptest.NewServer(server)
+
+		receiver := config.Receiver{Name: "ops", Type: TypeWebhook, URL: ts.URL, Headers: map[string]string{"X-Token": "secret"}}
+		deliver(receiver, firing())
+		ts.Close()
+
+		if server.attempts() != test.attempts {
+			t.Errorf("%s: got %d attempts, want %d", test.name, server.attempts(), test.attempts)
+			continue
+		}
+
+		var message Message
+
+		if err := json.Unmarshal(server.bodies[0], &message); err != nil {
+			t.Errorf("%s: body isn't a message: %s", test.name, err)
+			continue
+		}
+
+		if message.Firing != 1 || len(message.Alerts) != 1 || !strings.Contains(message.Text, "connections on db1") {
+			t.Errorf("%s: got message %+v", test.name, message)
+		}
+
+		if server.headers[0].Get("X-Token") != "secret" || server.headers[0].Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got headers %v", test.name, server.headers[0])
+		}
+	}
+}
+
+func TestDeliverSlack(t *testing.T) {
+	server := &stub{statuses: []int{503}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	deliver(config.Receiver{Name: "ops", Type: TypeSlack, URL: ts.URL, Template: "{{.Firing}} firing"}, firing())
+
+	if server.attempts() != 2 {
+		t.Fatalf("got %d attempts, want 2", server.attempts())
+	}
+
+	var payload map[string]string
+
+	if err := json.Unmarshal(server.bodies[1], &payload); err != nil {
+		t.Fatalf("body isn't JSON: %s", err)
+	}
+
+	if len(payload) != 1 || payload["text"] != "1 firing" {
+		t.Errorf("got payload %v", payload)
+	}
+}
+
+// Just enough of an SMTP server to accept one message
+func smtpServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		data := []string{}
+		reading := false
+
+		reply("220 localhost ESMTP")
+
+		for {
+			line, err := reader.ReadString('\n')
+
+			if err != nil {
+				return
+			}
+
+			line = strings.TrimRight(line, "\r\n")
+
+			if reading {
+				if line == "." {
+					reading = false
+					received <- strings.Join(data, "\n")
+					reply("250 OK")
+				} else {
+					data = append(data, line)
+				}
+
+				continue
+			}
+
+			switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				reply("250 OK")
+			case "DATA":
+				reading = true
+				reply("354 Go ahead")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestDeliverEmail(t *testing.T) {
+	address, received := smtpServer(t)
+
+	receiver := config.Receiver{
+		Name:     "ops",
+		Type:     TypeEmail,
+		SMTPHost: address,
+		From:     "tsadmin@example.com",
+		To:       []string{"ops@example.com", "dba@example.com"},
+	}
+
+	deliver(receiver, firing())
+
+	select {
+	case body := <-received:
+		for _, want := range []string{
+			"From: tsadmin@example.com",
+			"To: ops@example.com, dba@example.com",
+			"Subject: [tsadmin] 1 firing, 0 resolved",
+			"[firing] connections on db1, value 95",
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("email doesn't contain %q:\n%s", want, body)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was received")
+	}
+}
+
+func TestDeliverEmailSubject(t *testing.T) {
+	address, received := smtpServer(t)
+
+	receiver := config.Receiver{
+		Name:     "ops",
+		Type:     TypeEmail,
+		SMTPHost: address,
+		From:     "tsadmin@example.com",
+		To:       []string{"ops@example.com"},
+		Subject:  "{{range .Alerts}}{{.Description}}{{end}}",
+	}
+
+	message := firing()
+	message.Alerts[0].Description = "too many\r\nBcc: everyone@example.com\n"
+
+	deliver(receiver, message)
+
+	select {
+	case body := <-received:
+		headers := strings.SplitN(body, "\n\n", 2)[0]
+
+		if !strings.Contains(headers, "Subject: too many Bcc: everyone@example.com\n") || strings.Contains(headers, "\nBcc:") {
+			t.Errorf("the subject added a header:\n%s", headers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was received")
+	}
+}
+
+func TestDeliverEmailMisconfigured(t *testing.T) {
+	err := send(config.Receiver{Name: "ops", Type: TypeEmail}, firing())
+
+	if _, permanent := err.(*permanentError); !permanent {
+		t.Errorf("got %v, want a permanent error", err)
+	}
+}
@@ -1 +1,48 @@
-var app = angular.module('tsadmin', ['tsadminFilters']);
+var app = angular.module('tsadmin', ['tsadminFilters', 'tsadminDirectives']);
+
+app.config(function($httpProvider) {
+  // Lets tsadmin tell our requests apart from cross site form posts
+  $httpProvider.defaults.headers.common['X-Requested-With'] = 'XMLHttpRequest';
+
+  // Send people to the login page when their session runs out
+  $httpProvider.interceptors.push(function($q, $window) {
+    return {
+      responseError: function(response) {
+        if (response.status === 401 && $window.location.pathname !== '/login.html') {
+          $window.location.href = '/login.html';
+        }
+
+        return $q.reject(response);
+      }
+    };
+  });
+});
+
+// Who is logged in, if auth is turned on
+app.run(function($rootScope, $http, $window) {
+  $rootScope.identity = null;
+
+  $http.get('/session.json').success(function(data) {
+    $rootScope.identity = data;
+  });
+
+  // Whether the logged in user has the permission for the group, with no group
+  // meaning any group. Everything is allowed when auth is turned off.
+  $rootScope.can = function(permission, group) {
+    if (!$rootScope.identity) {
+      return true;
+    }
+
+    return ($rootScope.identity.grants || []).some(function(grant) {
+      var inGroup = group === undefined || !grant.groups || grant.groups.indexOf(group) !== -1;
+
+      return inGroup && (grant.permissions || []).indexOf(permission) !== -1;
+    });
+  };
+
+  $rootScope.logout = function() {
+    $http.post('/logout').success(function() {
+      $window.location.href = '/login.html';
+    });
+  };
+});
@@ -1,12 +1,286 @@
 'use strict';
 
-app.controller('MainController', function($scope, $http, $interval) { 
+app.controller('MainController', function($scope, $http, $interval, $window) { 
+  $scope.databases = {};
+  $scope.topology = [];
+  $scope.clusters = [];
+  $scope.alerts = [];
+  $scope.firing = {};
+  $scope.generation = null;
+  $scope.unchangedPolls = 0;
+  $scope.stale = false;
+
+  // How far back the sparklines go
+  $scope.ranges = [
+    { label: '5m', since: '5m' },
+    { label: '1h', since: '1h' },
+    { label: '24h', since: '24h' },
+    { label: '7d', since: '7d' },
+    { label: '30d', since: '30d' }
+  ];
+  $scope.range = $scope.ranges[0];
+
+  // Extra columns people can turn on, remembered in the browser
+  $scope.optionalColumns = [
+    { key: 'network', label: 'Network in/out' },
+    { key: 'rows', label: 'Rows read/changed p/s' },
+    { key: 'rows_examined', label: 'Rows examined/query' },
+    { key: 'tmp_tables', label: 'Disk tmp tables' },
+    { key: 'sorts_joins', label: 'Merge passes/full joins/scans p/s' },
+    { key: 'locks', label: 'Lock waits' },
+    { key: 'buffer_pool_hit_ratio', label: 'Buffer pool hit' },
+    { key: 'dirty_pages', label: 'Dirty pages' },
+    { key: 'data_io', label: 'Data reads/writes p/s' },
+    { key: 'pending_io', label: 'Pending I/O' }
+  ];
+  $scope.columns = angular.fromJson($window.localStorage.getItem('tsadmin.columns') || '{}');
+
+  $scope.$watch('columns', function(columns) {
+    $window.localStorage.setItem('tsadmin.columns', angular.toJson(columns));
+  }, true);
+
+  // How many columns the table has, for the cluster headings
+  $scope.columnCount = function() {
+    var count = 11;
+
+    angular.forEach($scope.optionalColumns, function(column) {
+      if ($scope.columns[column.key]) {
+        count++;
+      }
+    });
+
+    return count;
+  };
+
   $scope.fetch = function() {
-    $http.get('/status.json').success(function(data) {
-      $scope.databases = data;
+    $http.get('/status.json').success(function(data, status, headers) {
+      // If the generation hasn't moved on for a few polls the data is stale
+      var generation = headers('X-Tsadmin-Generation');
+
+      if (generation === $scope.generation) {
+        $scope.unchangedPolls++;
+      } else {
+        $scope.unchangedPolls = 0;
+      }
+
+      $scope.generation = generation;
+      $scope.collectedAt = new Date(headers('X-Tsadmin-Collected-At'));
+      $scope.stale = $scope.unchangedPolls >= 5;
+      $scope.databases = {};
+
+      angular.forEach(data, function(database) {
+        $scope.databases[database.metadata.name] = database;
+      });
+
+      $scope.group();
+    }).error(function() {
+      // tsadmin itself is unreachable
+      $scope.unchangedPolls++;
+      $scope.stale = $scope.unchangedPolls >= 5;
+    });
+
+    $http.get('/topology.json').success(function(data) {
+      $scope.topology = data;
+      $scope.group();
+    });
+
+    $http.get('/alerts.json').success(function(data) {
+      $scope.alerts = data;
+      $scope.firing = {};
+
+      angular.forEach(data, function(alert) {
+        if (alert.state === 'firing') {
+          $scope.firing[alert.database] = ($scope.firing[alert.database] || []).concat([alert]);
+        }
+      });
+    });
+  };
+
+  // Group the databases under their primary, each root of the topology is a cluster
+  $scope.group = function() {
+    var clusters = [];
+
+    angular.forEach($scope.topology, function(root) {
+      var cluster = { name: root.name, members: [] };
+
+      var walk = function(node, depth) {
+        if ($scope.databases[node.name]) {
+          cluster.members.push({ name: node.name, role: node.role, depth: depth, database: $scope.databases[node.name] });
+        }
+
+        angular.forEach(node.replicas, function(replica) {
+          walk(replica, depth + 1);
+        });
+      };
+
+      walk(root, 0);
+      clusters.push(cluster);
     });
+
+    $scope.clusters = clusters;
   };
 
   $scope.fetch();
   $interval($scope.fetch, 1000);
 });
+
+app.controller('HistoryController', function($scope, $http, $location) {
+  var search = $location.search();
+  var now = new Date();
+
+  $scope.names = [];
+  $scope.name = search.name;
+  $scope.metric = search.metric || 'queries_per_second';
+  $scope.since = new Date(now.getTime() - 3600 * 1000);
+  $scope.until = now;
+
+  $http.get('/status.json').success(function(data) {
+    $scope.names = data.map(function(database) {
+      return database.metadata.name;
+    }).sort();
+
+    $scope.name = $scope.name || $scope.names[0];
+  });
+
+  // The history endpoint takes unix timestamps
+  $scope.timestamp = function(date) {
+    return date ? Math.floor(date.getTime() / 1000) : '';
+  };
+});
+
+app.controller('MaintenanceController', function($scope, $http) {
+  $scope.windows = [];
+  $scope.names = [];
+  $scope.groups = [];
+  $scope.window = { scope: 'database', duration: '1h' };
+  $scope.groupOf = {};
+  $scope.error = null;
+
+  $scope.fetch = function() {
+    $http.get('/maintenance.json').success(function(data) {
+      $scope.windows = data;
+    });
+  };
+
+  $http.get('/status.json').success(function(data) {
+    var groups = {};
+
+    angular.forEach(data, function(database) {
+      $scope.names.push(database.metadata.name);
+      $scope.groupOf[database.metadata.name] = database.metadata.group;
+
+      if (database.metadata.group) {
+        groups[database.metadata.group] = true;
+      }
+    });
+
+    $scope.names.sort();
+    $scope.groups = Object.keys(groups).sort();
+  });
+
+  $scope.add = function() {
+    var window = {
+      reason: $scope.window.reason,
+      author: $scope.window.author,
+      duration: $scope.window.duration
+    };
+
+    window[$scope.window.scope] = $scope.window.target;
+
+    $http.post('/maintenance.json', window).success(function() {
+      $scope.error = null;
+      $scope.window.reason = '';
+      $scope.fetch();
+    }).error(function(data) {
+      $scope.error = data.error;
+    });
+  };
+
+  $scope.remove = function(window) {
+    $http.delete('/maintenance/' + window.id).success($scope.fetch);
+  };
+
+  $scope.fetch();
+});
+
+app.controller('LoginController', function($scope, $http, $window) {
+  $scope.credentials = { username: '', password: '' };
+  $scope.error = null;
+
+  $scope.login = function() {
+    $http.post('/login', $scope.credentials).success(function() {
+      $window.location.href = '/';
+    }).error(function(data) {
+      $scope.error = data.error;
+    });
+  };
+});
+
+app.controller('ProcesslistController', function($scope, $http, $interval, $location, $window) {
+  $scope.name = $location.search().name;
+  $scope.processes = [];
+  $scope.blocking = [];
+  $scope.error = null;
+  $scope.filter = { hide_sleep: true, min_time: '', user: '' };
+  $scope.sort = 'time';
+  $scope.order = 'desc';
+
+  $scope.fetch = function() {
+    var params = angular.extend({ sort: $scope.sort, order: $scope.order }, $scope.filter);
+
+    $http.get('/databases/' + encodeURIComponent($scope.name) + '/processlist.json', { params: params }).success(function(data) {
+      $scope.processes = data.processes;
+      $scope.group = data.group;
+      $scope.collectedAt = data.collected_at;
+      $scope.error = null;
+    }).error(function(data) {
+      $scope.error = data && data.error;
+    });
+
+    $http.get('/databases/' + encodeURIComponent($scope.name) + '/locks.json').success(function(data) {
+      $scope.blocking = data.blocking;
+    });
+  };
+
+  // Clicking a column sorts by it, clicking it again flips the order
+  $scope.sortBy = function(column) {
+    if ($scope.sort === column) {
+      $scope.order = $scope.order === 'desc' ? 'asc' : 'desc';
+    } else {
+      $scope.sort = column;
+      $scope.order = column === 'time' ? 'desc' : 'asc';
+    }
+
+    $scope.fetch();
+  };
+
+  // Kill the query or connection of a thread once they've confirmed it, if the
+  // thread has moved on to another query in the meantime it is left alone
+  $scope.kill = function(process, type) {
+    var message = 'Kill the ' + type + ' of thread ' + process.id + ' (' + process.user + ') on ' + $scope.name + '?';
+
+    if (process.query) {
+      message += '\n\n' + process.query;
+    }
+
+    if (!$window.confirm(message)) {
+      return;
+    }
+
+    $http.post('/databases/' + encodeURIComponent($scope.name) + '/kill', { id: process.id, query_hash: process.query_hash, type: type }).success(function() {
+      $scope.message = 'Killed the ' + type + ' of thread ' + process.id;
+      $scope.error = null;
+      $scope.fetch();
+    }).error(function(data) {
+      $scope.error = data && data.error;
+    });
+  };
+
+  $scope.$watch('filter', $scope.fetch, true);
+
+  var refresh = $interval($scope.fetch, 2000);
+
+  $scope.$on('$destroy', function() {
+    $interval.cancel(refresh);
+  });
+});
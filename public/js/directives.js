@@ -0,0 +1,62 @@
+'use strict';
+
+angular.module('tsadminDirectives', []).directive('sparkline', function($http, $interval) {
+  return {
+    restrict: 'E',
+    scope: { name: '@', metric: '@', since: '@', until: '@', width: '@', height: '@' },
+    template: '<svg class="sparkline" ng-attr-width="{{ width || 100 }}" ng-attr-height="{{ height || 20 }}"><polyline ng-attr-points="{{ points }}"/></svg>',
+    link: function(scope) {
+      scope.points = '';
+
+      var fetch = function() {
+        var width = parseInt(scope.width, 10) || 100;
+        var height = parseInt(scope.height, 10) || 20;
+        var params = { metric: scope.metric, since: scope.since || '5m' };
+
+        if (scope.until) {
+          params.until = scope.until;
+        }
+
+        $http.get('/history/' + encodeURIComponent(scope.name) + '.json', { params: params }).success(function(data) {
+          var points = data.points;
+
+          if (points.length < 2) {
+            scope.points = '';
+            return;
+          }
+
+          // Scale the points to fit the box, leaving a pixel either side for the line
+          var first = points[0][0];
+          var last = points[points.length - 1][0];
+          var max = 0;
+
+          angular.forEach(points, function(point) {
+            max = Math.max(max, point[1]);
+          });
+
+          scope.points = points.map(function(point) {
+            var x = (point[0] - first) / (last - first) * width;
+            var y = height - 1 - (max > 0 ? point[1] / max * (height - 2) : 0);
+
+            return x.toFixed(1) + ',' + y.toFixed(1);
+          }).join(' ');
+        });
+      };
+
+      fetch();
+
+      var timer = $interval(fetch, 5000);
+
+      // Refetch straight away when we are pointed at something else
+      scope.$watchGroup(['name', 'metric', 'since', 'until'], function(current, previous) {
+        if (current !== previous) {
+          fetch();
+        }
+      });
+
+      scope.$on('$destroy', function() {
+        $interval.cancel(timer);
+      });
+    }
+  };
+});
@@ -1,6 +1,8 @@
 'use strict';
 
-angular.module('tsadminFilters', []).filter('prettyUptime', function() {
+angular.module('tsadminFilters', [])
+
+.filter('prettyUptime', function() {
   return function(time) {
     // Minutes
     if (time > 60 && time < 3600) {
@@ -35,4 +37,51 @@ angular.module('tsadminFilters', []).filter('prettyUptime', function() {
       return time + 's';
     }
   };
+})
+
+.filter('replicationLag', function() {
+  return function(replication) {
+    // Not a replica
+    if (!replication || !replication.replica) {
+      return '-';
+    // One of the replication threads has stopped
+    } else if (replication.io_running !== 'Yes' || replication.sql_running !== 'Yes') {
+      return 'IO: ' + replication.io_running + ', SQL: ' + replication.sql_running;
+    // Lag is unknown
+    } else if (replication.seconds_behind_master === null) {
+      return '?';
+    } else {
+      return replication.seconds_behind_master + 's';
+    }
+  };
+})
+
+.filter('replicationClass', function() {
+  return function(replication) {
+    if (!replication || !replication.replica) {
+      return '';
+    // Broken replicas are the most important thing to spot
+    } else if (replication.io_running !== 'Yes' || replication.sql_running !== 'Yes') {
+      return 'danger';
+    // Lagging by more than 30 seconds
+    } else if (replication.seconds_behind_master === null || replication.seconds_behind_master > 30) {
+      return 'warning';
+    } else {
+      return '';
+    }
+  };
+})
+
+.filter('prettyBytes', function() {
+  return function(bytes) {
+    var units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    var unit = 0;
+
+    while (bytes >= 1024 && unit < units.length - 1) {
+      bytes /= 1024;
+      unit++;
+    }
+
+    return (unit === 0 ? Math.round(bytes) : bytes.toFixed(1)) + units[unit];
+  };
 });
@@ -0,0 +1,231 @@
+// tsadmin/statements
+package statements
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+// What the top statements can be sorted by
+const (
+	SortTotalLatency = "total_latency"
+	SortCount        = "count"
+	SortAvgLatency   = "avg_latency"
+	SortRowsExamined = "rows_examined"
+)
+
+// How long we give each database to answer, the digest table can be quite big so
+// the tracker has its own pool of connections with this timeout
+const collectTimeout = 10 * time.Second
+
+// Statement is what a normalized statement did during an interval
+type Statement struct {
+	Schema       string  `json:"schema"`
+	Digest       string  `json:"digest"`
+	Text         string  `json:"text"`
+	Count        uint64  `json:"count"`
+	TotalLatency float64 `json:"total_latency"`
+	AvgLatency   float64 `json:"avg_latency"`
+	RowsExamined uint64  `json:"rows_examined"`
+	RowsSent     uint64  `json:"rows_sent"`
+}
+
+// Interval is the statements that ran between two collections
+type Interval struct {
+	Since      time.Time   `json:"since"`
+	Until      time.Time   `json:"until"`
+	Statements []Statement `json:"statements"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Tracker collects the statement digests of each database and works out what
+// changed since the previous collection
+type Tracker struct {
+	mutex     sync.RWMutex
+	pool      *database.Pool
+	samples   map[string]*sample
+	intervals map[string]*Interval
+}
+
+type sample struct {
+	at     time.Time
+	totals map[string]database.StatementTotals
+}
+
+func New() *Tracker {
+	return &Tracker{
+		pool:      database.NewPoolWithTimeout(collectTimeout),
+		samples:   make(map[string]*sample),
+		intervals: make(map[string]*Interval),
+	}
+}
+
+// Collect the digests of the given databases, anything not in the list is
+// forgotten about and starts again from scratch next time
+func (t *Tracker) Collect(databases []database.Database) {
+	t.pool.Retain(databases)
+
+	wg := sync.WaitGroup{}
+	keep := make(map[string]bool)
+
+	for _, db := range databases {
+		keep[db.Name] = true
+		wg.Add(1)
+
+		go func(db database.Database) {
+			defer wg.Done()
+			t.collect(db)
+		}(db)
+	}
+
+	wg.Wait()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for name := range t.samples {
+		if !keep[name] {
+			delete(t.samples, name)
+			delete(t.intervals, name)
+		}
+	}
+}
+
+func (t *Tracker) collect(db database.Database) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	now := time.Now()
+	rows, err := database.Statements(ctx, t.pool, db)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Keep showing the last interval we have along with what went wrong
+	if err != nil {
+		interval, ok := t.intervals[db.Name]
+
+		if !ok {
+			interval = &Interval{Statements: []Statement{}}
+			t.intervals[db.Name] = interval
+		}
+
+		interval.Error = err.Error()
+
+		return
+	}
+
+	current := &sample{at: now, totals: make(map[string]database.StatementTotals)}
+
+	for _, row := range rows {
+		current.totals[row.Schema+"/"+row.Digest] = row
+	}
+
+	if previous, ok := t.samples[db.Name]; ok {
+		t.intervals[db.Name] = delta(previous, current)
+	}
+
+	t.samples[db.Name] = current
+}
+
+// Work out what each statement did between two samples
+func delta(previous *sample, current *sample) *Interval {
+	interval := &Interval{Since: previous.at, Until: current.at, Statements: []Statement{}}
+
+	for key, now := range current.totals {
+		then, ok := previous.totals[key]
+
+		// The table was truncated or the server restarted, or this statement was
+		// pushed out of the table and came back, so count everything
+		if !ok || now.Count < then.Count {
+			then = database.StatementTotals{}
+		}
+
+		count := now.Count - then.Count
+
+		if count == 0 {
+			continue
+		}
+
+		statement := Statement{
+			Schema:       now.Schema,
+			Digest:       now.Digest,
+			Text:         now.Text,
+			Count:        count,
+			TotalLatency: picoseconds(difference(now.TimerWait, then.TimerWait)),
+			RowsExamined: difference(now.RowsExamined, then.RowsExamined),
+			RowsSent:     difference(now.RowsSent, then.RowsSent),
+		}
+
+		statement.AvgLatency = statement.TotalLatency / float64(count)
+		interval.Statements = append(interval.Statements, statement)
+	}
+
+	return interval
+}
+
+// ValidSort reports whether the statements can be sorted by the given key
+func ValidSort(key string) bool {
+	switch key {
+	case SortTotalLatency, SortCount, SortAvgLatency, SortRowsExamined:
+		return true
+	}
+
+	return false
+}
+
+// Top returns the statements the database ran in the latest interval, sorted by
+// the given key with the biggest first. If we haven't collected two samples yet
+// there is no interval and ok is false.
+func (t *Tracker) Top(name string, key string, limit int) (Interval, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	latest, ok := t.intervals[name]
+
+	if !ok {
+		return Interval{Statements: []Statement{}}, false
+	}
+
+	interval := *latest
+	interval.Statements = append([]Statement{}, latest.Statements...)
+
+	sort.Slice(interval.Statements, func(i, j int) bool {
+		a, b := interval.Statements[i], interval.Statements[j]
+
+		switch key {
+		case SortCount:
+			return a.Count > b.Count
+		case SortAvgLatency:
+			return a.AvgLatency > b.AvgLatency
+		case SortRowsExamined:
+			return a.RowsExamined > b.RowsExamined
+		default:
+			return a.TotalLatency > b.TotalLatency
+		}
+	})
+
+	if limit > 0 && len(interval.Statements) > limit {
+		interval.Statements = interval.Statements[:limit]
+	}
+
+	return interval, true
+}
+
+// The sum columns can go down when rows are reset individually, never go negative
+func difference(now uint64, then uint64) uint64 {
+	if now < then {
+		return now
+	}
+
+	return now - then
+}
+
+// performance_schema timers are in picoseconds
+func picoseconds(value uint64) float64 {
+	return float64(value) / 1e12
+}
@@ -0,0 +1,537 @@
+// tsadmin/storage
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+// The resolutions data is stored at
+const (
+	Raw    = "raw"
+	Minute = "1m"
+	Hour   = "1h"
+)
+
+// Each resolution is split into files covering a fixed period of time so old
+// data can be removed by deleting whole files
+var resolutions = map[string]struct {
+	bucket  time.Duration
+	segment string
+}{
+	Raw:    {bucket: 0, segment: "2006-01-02-15"},
+	Minute: {bucket: time.Minute, segment: "2006-01-02"},
+	Hour:   {bucket: time.Hour, segment: "2006-01"},
+}
+
+// How far back we go through the raw data to rebuild the aggregates on startup
+const maxRebuild = 24 * time.Hour
+
+// Storage persists every status to disk as JSON lines and rolls the values up into
+// 1 minute and 1 hour aggregates. Aggregates for the current minute and hour are
+// kept in memory until they are complete, if we are stopped before then they are
+// rebuilt from the raw data when the storage is next opened.
+type Storage struct {
+	mutex     sync.Mutex
+	path      string
+	retention map[string]time.Duration
+	rollups   map[string]map[string]*bucket
+	files     map[string]*os.File
+	pruned    time.Time
+}
+
+// Aggregate is the min, max and average of a metric over a period of time
+type Aggregate struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Count int     `json:"count"`
+}
+
+// Point is a value of a metric from storage, for raw data Min, Max and Avg are
+// all the same value
+type Point struct {
+	Time time.Time
+	Aggregate
+}
+
+// A line in the 1m or 1h files
+type aggregateLine struct {
+	Time   time.Time            `json:"time"`
+	Values map[string]Aggregate `json:"values"`
+}
+
+// The aggregate that is currently being built up for a database
+type bucket struct {
+	start  time.Time
+	values map[string]*Aggregate
+}
+
+// Open the storage in the given directory, creating it if needed
+func Open(path string) (*Storage, error) {
+	for resolution := range resolutions {
+		if err := os.MkdirAll(filepath.Join(path, resolution), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Storage{
+		path:      path,
+		retention: make(map[string]time.Duration),
+		rollups:   map[string]map[string]*bucket{Minute: {}, Hour: {}},
+		files:     make(map[string]*os.File),
+	}
+
+	if err := s.rebuild(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Roll up any raw data that came after the last aggregates we wrote out, this
+// finishes off the buckets that were in progress when we were last stopped
+func (s *Storage) rebuild(now time.Time) error {
+	databases, err := filepath.Glob(filepath.Join(s.path, Raw, "*"))
+
+	if err != nil {
+		return err
+	}
+
+	for _, directory := range databases {
+		name, err := url.PathUnescape(filepath.Base(directory))
+
+		if err != nil {
+			continue
+		}
+
+		// Where each resolution needs to pick up from
+		from := make(map[string]time.Time)
+		earliest := now
+
+		for _, resolution := range []string{Minute, Hour} {
+			last, err := s.lastRollup(resolution, name)
+
+			if err != nil {
+				return err
+			}
+
+			from[resolution] = now.Add(-maxRebuild)
+
+			if !last.IsZero() && last.Add(resolutions[resolution].bucket).After(from[resolution]) {
+				from[resolution] = last.Add(resolutions[resolution].bucket)
+			}
+
+			if from[resolution].Before(earliest) {
+				earliest = from[resolution]
+			}
+		}
+
+		segments, err := filepath.Glob(filepath.Join(directory, "*.jsonl"))
+
+		if err != nil {
+			return err
+		}
+
+		sort.Strings(segments)
+
+		for _, segment := range segments {
+			start, err := time.Parse(resolutions[Raw].segment, strings.TrimSuffix(filepath.Base(segment), ".jsonl"))
+
+			if err != nil || !segmentEnd(Raw, start).After(earliest) {
+				continue
+			}
+
+			err = readStatuses(segment, func(status *database.DatabaseStatus) error {
+				values := status.Values()
+
+				for _, resolution := range []string{Minute, Hour} {
+					if status.CollectedAt.Before(from[resolution]) {
+						continue
+					}
+
+					if err := s.rollup(resolution, name, status.CollectedAt, values); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// The start of the last aggregate written out for the database at the given
+// resolution, or zero if there isn't one
+func (s *Storage) lastRollup(resolution string, name string) (time.Time, error) {
+	segments, err := filepath.Glob(filepath.Join(s.path, resolution, url.PathEscape(name), "*.jsonl"))
+
+	if err != nil || len(segments) == 0 {
+		return time.Time{}, err
+	}
+
+	sort.Strings(segments)
+
+	file, err := os.Open(segments[len(segments)-1])
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	defer file.Close()
+
+	last := time.Time{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := aggregateLine{}
+
+		// A partially written line from a crash, skip it
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+
+		last = line.Time
+	}
+
+	return last, scanner.Err()
+}
+
+// Set how long data is kept at each resolution, a retention of 0 keeps it forever
+func (s *Storage) SetRetention(resolution string, retention time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.retention[resolution] = retention
+}
+
+// How long data is kept at the given resolution
+func (s *Storage) Retention(resolution string) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.retention[resolution]
+}
+
+// Write the latest statuses to disk
+func (s *Storage) Write(statuses map[string]*database.DatabaseStatus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, status := range statuses {
+		line, err := json.Marshal(status)
+
+		if err != nil {
+			return err
+		}
+
+		if err := s.append(Raw, name, status.CollectedAt, line); err != nil {
+			return err
+		}
+
+		values := status.Values()
+
+		for _, resolution := range []string{Minute, Hour} {
+			if err := s.rollup(resolution, name, status.CollectedAt, values); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Once an hour is plenty often enough to clear out old data
+	if time.Since(s.pruned) > time.Hour {
+		s.pruned = time.Now()
+
+		return s.prune()
+	}
+
+	return nil
+}
+
+// Add the values to the current bucket at the given resolution, writing the bucket
+// out once we have moved on to the next one
+func (s *Storage) rollup(resolution string, name string, at time.Time, values map[string]float64) error {
+	start := at.Truncate(resolutions[resolution].bucket)
+	current, ok := s.rollups[resolution][name]
+
+	if ok && !current.start.Equal(start) {
+		if err := s.flush(resolution, name, current); err != nil {
+			return err
+		}
+
+		ok = false
+	}
+
+	if !ok {
+		current = &bucket{start: start, values: make(map[string]*Aggregate)}
+		s.rollups[resolution][name] = current
+	}
+
+	for metric, value := range values {
+		aggregate, ok := current.values[metric]
+
+		if !ok {
+			current.values[metric] = &Aggregate{Min: value, Max: value, Avg: value, Count: 1}
+			continue
+		}
+
+		aggregate.Min = math.Min(aggregate.Min, value)
+		aggregate.Max = math.Max(aggregate.Max, value)
+		aggregate.Avg += (value - aggregate.Avg) / float64(aggregate.Count+1)
+		aggregate.Count++
+	}
+
+	return nil
+}
+
+func (s *Storage) flush(resolution string, name string, current *bucket) error {
+	line := aggregateLine{Time: current.start, Values: make(map[string]Aggregate)}
+
+	for metric, aggregate := range current.values {
+		line.Values[metric] = *aggregate
+	}
+
+	encoded, err := json.Marshal(line)
+
+	if err != nil {
+		return err
+	}
+
+	return s.append(resolution, name, current.start, encoded)
+}
+
+// Append a line to the file for the given resolution and time
+func (s *Storage) append(resolution string, name string, at time.Time, line []byte) error {
+	path := s.segmentPath(resolution, name, at)
+	file, ok := s.files[path]
+
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		var err error
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		// We've moved on to a new segment so close the previous one
+		prefix := filepath.Dir(path)
+
+		for open, previous := range s.files {
+			if filepath.Dir(open) == prefix {
+				previous.Close()
+				delete(s.files, open)
+			}
+		}
+
+		s.files[path] = file
+	}
+
+	_, err := file.Write(append(line, '\n'))
+
+	return err
+}
+
+func (s *Storage) segmentPath(resolution string, name string, at time.Time) string {
+	return filepath.Join(s.path, resolution, url.PathEscape(name), at.UTC().Format(resolutions[resolution].segment)+".jsonl")
+}
+
+// Remove any segments that are entirely older than the retention
+func (s *Storage) prune() error {
+	for resolution, config := range resolutions {
+		retention := s.retention[resolution]
+
+		if retention <= 0 {
+			continue
+		}
+
+		cutoff := time.Now().Add(-retention)
+		segments, err := filepath.Glob(filepath.Join(s.path, resolution, "*", "*.jsonl"))
+
+		if err != nil {
+			return err
+		}
+
+		for _, segment := range segments {
+			start, err := time.Parse(config.segment, strings.TrimSuffix(filepath.Base(segment), ".jsonl"))
+
+			if err != nil || !segmentEnd(resolution, start).Before(cutoff) {
+				continue
+			}
+
+			if file, ok := s.files[segment]; ok {
+				file.Close()
+				delete(s.files, segment)
+			}
+
+			if err := os.Remove(segment); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// When the segment starting at the given time ends
+func segmentEnd(resolution string, start time.Time) time.Time {
+	switch resolution {
+	case Raw:
+		return start.Add(time.Hour)
+	case Minute:
+		return start.AddDate(0, 0, 1)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// Read the values of a metric for the given database between since and until
+func (s *Storage) Points(resolution string, name string, metric string, since time.Time, until time.Time) ([]Point, error) {
+	config, ok := resolutions[resolution]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown resolution %s", resolution)
+	}
+
+	s.mutex.Lock()
+	segments, err := filepath.Glob(filepath.Join(s.path, resolution, url.PathEscape(name), "*.jsonl"))
+	s.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(segments)
+	points := []Point{}
+
+	for _, segment := range segments {
+		start, err := time.Parse(config.segment, strings.TrimSuffix(filepath.Base(segment), ".jsonl"))
+
+		// Skip any segments outside of the range
+		if err != nil || !segmentEnd(resolution, start).After(since) || start.After(until) {
+			continue
+		}
+
+		segmentPoints, err := readSegment(resolution, segment, metric, since, until)
+
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, segmentPoints...)
+	}
+
+	return points, nil
+}
+
+func readSegment(resolution string, path string, metric string, since time.Time, until time.Time) ([]Point, error) {
+	points := []Point{}
+
+	keep := func(point Point) {
+		if !point.Time.Before(since) && !point.Time.After(until) {
+			points = append(points, point)
+		}
+	}
+
+	if resolution == Raw {
+		err := readStatuses(path, func(status *database.DatabaseStatus) error {
+			if value, ok := status.Values()[metric]; ok {
+				keep(Point{Time: status.CollectedAt, Aggregate: Aggregate{Min: value, Max: value, Avg: value, Count: 1}})
+			}
+
+			return nil
+		})
+
+		return points, err
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := aggregateLine{}
+
+		// A partially written line from a crash, skip it
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+
+		if aggregate, ok := line.Values[metric]; ok {
+			keep(Point{Time: line.Time, Aggregate: aggregate})
+		}
+	}
+
+	return points, scanner.Err()
+}
+
+// Call fn with each status in a raw segment, in the order they were written
+func readStatuses(path string, fn func(status *database.DatabaseStatus) error) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		status := &database.DatabaseStatus{}
+
+		// A partially written line from a crash, skip it
+		if err := json.Unmarshal(scanner.Bytes(), status); err != nil {
+			continue
+		}
+
+		if err := fn(status); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Close all the open files, the aggregates that aren't complete yet are left for
+// the next Open to rebuild from the raw data so each one is only written once
+func (s *Storage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for path, file := range s.files {
+		file.Close()
+		delete(s.files, path)
+	}
+
+	return nil
+}
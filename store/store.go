@@ -0,0 +1,81 @@
+// tsadmin/store
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+// Store holds the most recent statuses of each database, it's safe to read from
+// while the next set of statuses is being collected. Statuses are never modified
+// once they have been added to the store.
+type Store struct {
+	mutex       sync.RWMutex
+	current     map[string]*database.DatabaseStatus
+	generation  uint64
+	collectedAt time.Time
+}
+
+// Snapshot is a consistent view of the store at a point in time
+type Snapshot struct {
+	Generation  uint64
+	CollectedAt time.Time
+	Statuses    []*database.DatabaseStatus
+}
+
+func New() *Store {
+	return &Store{
+		current: make(map[string]*database.DatabaseStatus),
+	}
+}
+
+// Replace the current statuses with the latest collection, returning the new generation
+func (s *Store) Update(statuses map[string]*database.DatabaseStatus) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.current = make(map[string]*database.DatabaseStatus)
+
+	for name, status := range statuses {
+		s.current[name] = status
+	}
+
+	s.generation++
+	s.collectedAt = time.Now()
+
+	return s.generation
+}
+
+// The most recent status of the given database, this is what the next status
+// is compared against to calculate rates
+func (s *Store) Latest(name string) *database.DatabaseStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.current[name]
+}
+
+// Take a snapshot of the current statuses, sorted by name
+func (s *Store) Snapshot() Snapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snapshot := Snapshot{
+		Generation:  s.generation,
+		CollectedAt: s.collectedAt,
+		Statuses:    []*database.DatabaseStatus{},
+	}
+
+	for _, status := range s.current {
+		snapshot.Statuses = append(snapshot.Statuses, status)
+	}
+
+	sort.Slice(snapshot.Statuses, func(i, j int) bool {
+		return snapshot.Statuses[i].Metadata.Name < snapshot.Statuses[j].Metadata.Name
+	})
+
+	return snapshot
+}
@@ -0,0 +1,192 @@
+// tsadmin/topology
+package topology
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jamesrwhite/tsadmin/database"
+)
+
+const (
+	RolePrimary      = "primary"
+	RoleIntermediate = "intermediate"
+	RoleReplica      = "replica"
+	RoleStandalone   = "standalone"
+)
+
+type Node struct {
+	Name       string  `json:"name"`
+	Host       string  `json:"host"`
+	Port       int     `json:"port"`
+	Role       string  `json:"role"`
+	ServerID   int     `json:"server_id"`
+	ServerUUID string  `json:"server_uuid"`
+	ReadOnly   bool    `json:"read_only"`
+	Master     string  `json:"master,omitempty"`
+	Replicas   []*Node `json:"replicas"`
+	parent     *Node
+	status     *database.DatabaseStatus
+}
+
+// Build the replication topology of the given databases, returning a tree for each
+// cluster with the primary at the root and its replicas beneath it
+func Build(statuses []*database.DatabaseStatus) []*Node {
+	nodes := []*Node{}
+
+	for _, status := range statuses {
+		nodes = append(nodes, &Node{
+			Name:       status.Metadata.Name,
+			Host:       status.Metadata.Host,
+			Port:       status.Metadata.Port,
+			ServerID:   status.Variables.ServerID,
+			ServerUUID: status.Variables.ServerUUID,
+			ReadOnly:   status.Variables.ReadOnly,
+			Replicas:   []*Node{},
+			status:     status,
+		})
+	}
+
+	// Work out who each replica is replicating from
+	for _, node := range nodes {
+		replication := node.status.Replication
+
+		if !replication.Replica {
+			continue
+		}
+
+		node.parent = findMaster(node, nodes)
+
+		// We don't monitor the master so just record where it is
+		if node.parent == nil {
+			node.Master = fmt.Sprintf("%s:%d", replication.MasterHost, replication.MasterPort)
+		}
+	}
+
+	// Master-master setups would otherwise leave us without a root
+	for _, node := range nodes {
+		breakCycle(node)
+	}
+
+	// Attach each replica to its master
+	roots := []*Node{}
+
+	for _, node := range nodes {
+		if node.parent == nil {
+			roots = append(roots, node)
+		} else {
+			node.parent.Replicas = append(node.parent.Replicas, node)
+		}
+	}
+
+	for _, node := range nodes {
+		node.Role = role(node)
+		sortNodes(node.Replicas)
+	}
+
+	sortNodes(roots)
+
+	return roots
+}
+
+// Find the master of the given replica amongst the nodes we know about
+func findMaster(replica *Node, nodes []*Node) *Node {
+	replication := replica.status.Replication
+
+	// The UUID is the most reliable way of identifying a server
+	if replication.MasterUUID != "" {
+		for _, node := range nodes {
+			if node != replica && node.ServerUUID == replication.MasterUUID {
+				return node
+			}
+		}
+	}
+
+	// Then the server_id, as long as it is unique
+	if replication.MasterServerID != 0 {
+		var match *Node
+
+		for _, node := range nodes {
+			if node != replica && node.ServerID == replication.MasterServerID {
+				if match != nil {
+					match = nil
+					break
+				}
+
+				match = node
+			}
+		}
+
+		if match != nil {
+			return match
+		}
+	}
+
+	// Finally fall back to the host and port we are connecting to
+	for _, node := range nodes {
+		if node != replica && strings.EqualFold(node.Host, replication.MasterHost) && node.Port == replication.MasterPort {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// If the given node is part of a replication cycle then promote the writable
+// member of the cycle (or the first alphabetically) to be the root
+func breakCycle(start *Node) {
+	seen := map[*Node]bool{}
+	node := start
+
+	for node != nil && !seen[node] {
+		seen[node] = true
+		node = node.parent
+	}
+
+	// We reached a root so there is no cycle
+	if node == nil {
+		return
+	}
+
+	// Collect the members of the cycle and pick the best candidate
+	candidate := node
+
+	for member := node.parent; member != node; member = member.parent {
+		if better(member, candidate) {
+			candidate = member
+		}
+	}
+
+	candidate.parent = nil
+}
+
+// Whether a is a better choice of primary than b
+func better(a *Node, b *Node) bool {
+	if a.ReadOnly != b.ReadOnly {
+		return !a.ReadOnly
+	}
+
+	return a.Name < b.Name
+}
+
+func role(node *Node) string {
+	replicating := node.parent != nil || node.Master != ""
+
+	switch {
+	case replicating && len(node.Replicas) > 0:
+		return RoleIntermediate
+	case replicating:
+		return RoleReplica
+	case len(node.Replicas) > 0:
+		return RolePrimary
+	default:
+		return RoleStandalone
+	}
+}
+
+func sortNodes(nodes []*Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+}
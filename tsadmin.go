@@ -2,24 +2,85 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/jamesrwhite/tsadmin/alert"
+	"github.com/jamesrwhite/tsadmin/audit"
+	"github.com/jamesrwhite/tsadmin/auth"
 	"github.com/jamesrwhite/tsadmin/config"
 	"github.com/jamesrwhite/tsadmin/database"
+	"github.com/jamesrwhite/tsadmin/exporter"
+	"github.com/jamesrwhite/tsadmin/history"
+	"github.com/jamesrwhite/tsadmin/killer"
+	"github.com/jamesrwhite/tsadmin/maintenance"
+	"github.com/jamesrwhite/tsadmin/notify"
+	"github.com/jamesrwhite/tsadmin/statements"
+	"github.com/jamesrwhite/tsadmin/storage"
+	"github.com/jamesrwhite/tsadmin/store"
+	"github.com/jamesrwhite/tsadmin/topology"
 
 	"github.com/codegangsta/negroni"
 	"github.com/julienschmidt/httprouter"
 )
 
 var ticker = time.NewTicker(time.Second * 1)
-var statuses map[string]*database.DatabaseStatus
+var statuses = store.New()
+var metricHistory = history.New(0)
+var metricStorage *storage.Storage
+var alerts = alert.NewEngine()
+var notifier = notify.New()
+var schedule *maintenance.Schedule
+var auditLog *audit.Log
+var queryKiller *killer.Killer
+var statementTracker = statements.New()
+var authenticator = auth.New(func() config.AuthConfig {
+	return currentConfig().Auth
+})
+var activeConfig config.Config
+var configMutex sync.RWMutex
+var pool = database.NewPool()
+var requestPool = database.NewPoolWithTimeout(requestTimeout)
+var configError string
+
+// Set while a monitoring cycle is in progress
+var collecting int32
+
+// Set while the kill policies are being applied
+var killing int32
+
+// Set while the statement digests are being collected, and when that last started
+var collectingStatements int32
+var statementsCollectedAt time.Time
+
+// How long the statuses can go without updating before we report being unhealthy
+const healthyWithin = 10 * time.Second
+
+// How long we give the database to answer requests for things like the processlist,
+// these are run on demand so can take a bit longer than the regular checks and
+// have a pool of their own with this timeout
+const requestTimeout = 5 * time.Second
 
 func main() {
+	// Helpers for setting up auth
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1])
+		return
+	}
+
 	// Check the required env vars are set
 	if os.Getenv("PORT") == "" {
 		fmt.Println("You must set the PORT environment variable")
@@ -31,43 +92,634 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create an instance of our app
-	app := negroni.Classic()
+	// Load the config up front so we know where to store metrics, it gets
+	// reloaded on every check after this. There's no last known good config to
+	// fall back on yet so it has to work.
+	var err error
+	activeConfig, err = config.Load(os.Getenv("CONFIG_FILE"))
+
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	// Load the maintenance windows, changing the path also needs a restart
+	schedule, err = maintenance.Open(currentConfig().MaintenanceFile)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Open the audit log, this one needs a restart to move too
+	auditLog, err = audit.Open(currentConfig().AuditFile)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	queryKiller = killer.New(auditLog)
+
+	// Open the on disk storage, changing the path needs a restart
+	if path := currentConfig().Storage.Path; path != "" {
+		metricStorage, err = storage.Open(path)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Close the files cleanly when we are stopped, the rollups in progress are
+		// rebuilt from the raw statuses next time
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	// Create a new router
-	router := httprouter.New()
+		go func() {
+			<-signals
+
+			if err := metricStorage.Close(); err != nil {
+				log.Printf("Error closing storage: %s", err)
+			}
+
+			os.Exit(0)
+		}()
+	}
+
+	// Create an instance of our app, checking who people are before serving anything
+	app := negroni.New(negroni.NewRecovery(), negroni.NewLogger(), authenticator, negroni.NewStatic(http.Dir("public")))
+
+	// Create a new router, every route says what people need to be allowed to do to use it
+	router := authenticator.Router(httprouter.New(), groupOf)
 
 	// Fetch the initial statuses of the databases with 2 seconds of data
-	statuses, _ = monitor()
+	record(monitor())
 	time.Sleep(time.Second * 1)
-	statuses, _ = monitor()
+	record(monitor())
 
-	// Then refresh the statuses once a second
+	// Then refresh the statuses once a second, if the previous cycle is still
+	// running we skip this one rather than letting them queue up
 	go func() {
 		for range ticker.C {
-			statuses, _ = monitor()
+			if !atomic.CompareAndSwapInt32(&collecting, 0, 1) {
+				log.Println("Previous monitoring cycle still running, skipping this one")
+				continue
+			}
+
+			go func() {
+				defer atomic.StoreInt32(&collecting, 0)
+				record(monitor())
+				enforcePolicies()
+				collectStatements()
+			}()
 		}
 	}()
 
 	// Add our routes
-	router.GET("/status.json", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	router.POST("/login", auth.PermissionNone, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		authenticator.Login(w, r)
+	})
+
+	router.POST("/logout", auth.PermissionNone, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		authenticator.Logout(w, r)
+	})
+
+	router.GET("/session.json", auth.PermissionNone, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		// This is null when auth is turned off
+		var session interface{}
+
+		if identity := auth.FromRequest(r); identity != nil {
+			session = struct {
+				*auth.Identity
+				Grants []auth.GrantedRole `json:"grants"`
+			}{identity, authenticator.GrantedRoles(r)}
+		}
+
+		jsonResponse, _ := json.Marshal(session)
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/health", auth.PermissionNone, func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		if !currentConfig().Health {
+			jsonError(w, http.StatusNotFound, "the health endpoint is not enabled")
+			return
+		}
+
+		// We're healthy as long as the statuses are being updated
+		snapshot := statuses.Snapshot()
+		health := "ok"
+
+		if time.Since(snapshot.CollectedAt) > healthyWithin {
+			health = "stale"
+		}
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		if health != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		jsonResponse, _ := json.Marshal(map[string]interface{}{
+			"status":       health,
+			"generation":   snapshot.Generation,
+			"collected_at": snapshot.CollectedAt,
+		})
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/status.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		snapshot := statuses.Snapshot()
+
+		// JSON please, along with when the data was collected so clients can tell if it's stale
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Tsadmin-Generation", strconv.FormatUint(snapshot.Generation, 10))
+		w.Header().Set("X-Tsadmin-Collected-At", snapshot.CollectedAt.Format(time.RFC3339Nano))
+
+		// Encode the response
+		jsonResponse, _ := json.Marshal(visible(r, snapshot.Statuses))
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/topology.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		// JSON please
 		w.Header().Set("Content-Type", "application/json")
 
-		// Define our response array
-		response := []*database.DatabaseStatus{}
+		// Work out who replicates from who
+		jsonResponse, _ := json.Marshal(topology.Build(visible(r, statuses.Snapshot().Statuses)))
 
-		// Reformat the statuses map as a simple array for JSON
-		for _, status := range statuses {
-			response = append(response, status)
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/alerts.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		// Only the alerts for groups they can see
+		visibleAlerts := []alert.Alert{}
+
+		for _, current := range alerts.Alerts() {
+			if authenticator.Can(r, auth.PermissionView, current.Group) {
+				visibleAlerts = append(visibleAlerts, current)
+			}
 		}
 
 		// Encode the response
+		jsonResponse, _ := json.Marshal(visibleAlerts)
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/maintenance.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		// Only the windows for groups they can see
+		windows := []maintenance.Window{}
+
+		for _, window := range schedule.Windows(time.Now()) {
+			if authenticator.Can(r, auth.PermissionView, windowGroup(window)) {
+				windows = append(windows, window)
+			}
+		}
+
+		// Encode the response
+		jsonResponse, _ := json.Marshal(windows)
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.POST("/maintenance.json", auth.PermissionOperate, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// The window can either have an end or a duration, it starts now unless told otherwise
+		var request struct {
+			maintenance.Window
+			Duration string `json:"duration"`
+		}
+
+		if !fromScript(r) {
+			jsonError(w, http.StatusUnsupportedMediaType, "maintenance windows must be sent as application/json")
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid maintenance window: %s", err))
+			return
+		}
+
+		window := request.Window
+
+		// If we know who they are there's no need to take their word for it
+		if identity := auth.FromRequest(r); identity != nil {
+			window.Author = identity.Name
+		}
+
+		if window.Start.IsZero() {
+			window.Start = time.Now()
+		}
+
+		if window.End.IsZero() && request.Duration != "" {
+			duration, err := config.ParseDuration(request.Duration)
+
+			if err != nil {
+				jsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			window.End = window.Start.Add(duration)
+		}
+
+		if !authenticator.Can(r, auth.PermissionOperate, windowGroup(window)) {
+			jsonError(w, http.StatusForbidden, "you need the operate permission to do that")
+			return
+		}
+
+		window, err := schedule.Add(window)
+
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("%s put %s into maintenance until %s: %s", window.Author, window.Database+window.Group, window.End.Format(time.RFC3339), window.Reason)
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		jsonResponse, _ := json.Marshal(window)
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.DELETE("/maintenance/:id", auth.PermissionOperate, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if window := schedule.Get(ps.ByName("id")); window != nil && !authenticator.Can(r, auth.PermissionOperate, windowGroup(*window)) {
+			jsonError(w, http.StatusForbidden, "you need the operate permission to do that")
+			return
+		}
+
+		removed, err := schedule.Remove(ps.ByName("id"))
+
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !removed {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("unknown maintenance window %s", ps.ByName("id")))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	router.GET("/databases/:name/processlist.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		dbConfig, ok := databaseConfig(ps.ByName("name"))
+
+		if !ok {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("unknown database %s", ps.ByName("name")))
+			return
+		}
+
+		// Work out which threads they're interested in, the longest running first by default
+		query := r.URL.Query()
+		filter := database.ProcessFilter{
+			HideSleep:  query.Get("hide_sleep") == "true" || query.Get("hide_sleep") == "1",
+			User:       query.Get("user"),
+			Sort:       query.Get("sort"),
+			Descending: query.Get("order") != "asc",
+		}
+
+		if minTime := query.Get("min_time"); minTime != "" {
+			var err error
+			filter.MinTime, err = strconv.ParseInt(minTime, 10, 64)
+
+			if err != nil {
+				jsonError(w, http.StatusBadRequest, fmt.Sprintf("min_time must be a number of seconds, not %q", minTime))
+				return
+			}
+		}
+
+		if err := filter.Validate(); err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+
+		collectedAt := time.Now()
+		processes, err := database.Processlist(ctx, requestPool, dbConfig, filter)
+
+		if err != nil {
+			jsonError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		jsonResponse, _ := json.Marshal(map[string]interface{}{
+			"name":         dbConfig.Name,
+			"group":        dbConfig.Group,
+			"collected_at": collectedAt,
+			"processes":    processes,
+		})
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/databases/:name/locks.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		dbConfig, ok := databaseConfig(ps.ByName("name"))
+
+		if !ok {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("unknown database %s", ps.ByName("name")))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+
+		collectedAt := time.Now()
+		blocking, err := database.LockWaits(ctx, requestPool, dbConfig)
+
+		if err != nil {
+			jsonError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		jsonResponse, _ := json.Marshal(map[string]interface{}{
+			"name":         dbConfig.Name,
+			"group":        dbConfig.Group,
+			"collected_at": collectedAt,
+			"blocking":     blocking,
+		})
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.POST("/databases/:name/kill", auth.PermissionOperate, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		dbConfig, ok := databaseConfig(ps.ByName("name"))
+
+		if !ok {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("unknown database %s", ps.ByName("name")))
+			return
+		}
+
+		// The hash is of the query they saw in the processlist, we won't kill anything else
+		var request struct {
+			ID        int64  `json:"id"`
+			QueryHash string `json:"query_hash"`
+			Type      string `json:"type"`
+		}
+
+		if !fromScript(r) {
+			jsonError(w, http.StatusUnsupportedMediaType, "kill requests must be sent as application/json")
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid kill request: %s", err))
+			return
+		}
+
+		if request.ID <= 0 || request.QueryHash == "" {
+			jsonError(w, http.StatusBadRequest, "id and query_hash are required")
+			return
+		}
+
+		if request.Type == "" {
+			request.Type = database.KillQuery
+		}
+
+		if request.Type != database.KillQuery && request.Type != database.KillConnection {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("type must be %s or %s", database.KillQuery, database.KillConnection))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+
+		process, err := database.Kill(ctx, requestPool, dbConfig, request.ID, request.QueryHash, request.Type)
+
+		// Write down who tried to kill what whether it worked or not
+		entry := audit.Entry{
+			Actor:      actor(r),
+			RemoteAddr: r.RemoteAddr,
+			Action:     "kill-" + request.Type,
+			Database:   dbConfig.Name,
+			Group:      dbConfig.Group,
+			Thread:     request.ID,
+			QueryHash:  request.QueryHash,
+			Result:     audit.ResultOK,
+		}
+
+		if process != nil {
+			entry.User = process.User
+			entry.Query = process.Query
+		}
+
+		code := http.StatusOK
+
+		switch {
+		case err == database.ErrThreadGone || err == database.ErrQueryChanged:
+			entry.Result = audit.ResultRefused
+			code = http.StatusConflict
+		case err != nil:
+			entry.Result = audit.ResultFailed
+			code = http.StatusBadGateway
+		}
+
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		if auditErr := auditLog.Record(entry); auditErr != nil {
+			log.Printf("Error writing to the audit log: %s", auditErr)
+		}
+
+		log.Printf("%s killed %s %d on %s: %s", entry.Actor, request.Type, request.ID, dbConfig.Name, entry.Result)
+
+		if err != nil {
+			jsonError(w, code, err.Error())
+			return
+		}
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		jsonResponse, _ := json.Marshal(map[string]interface{}{
+			"killed": process,
+		})
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/audit.json", auth.PermissionOperate, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		limit := 100
+
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+
+			if limit, err = strconv.Atoi(value); err != nil {
+				jsonError(w, http.StatusBadRequest, fmt.Sprintf("limit must be a number, not %q", value))
+				return
+			}
+		}
+
+		name := r.URL.Query().Get("database")
+
+		// Only what happened in the groups they can operate on
+		entries, err := auditLog.Entries(limit, func(entry audit.Entry) bool {
+			return (name == "" || entry.Database == name) && authenticator.Can(r, auth.PermissionOperate, entry.Group)
+		})
+
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		jsonResponse, _ := json.Marshal(entries)
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/databases/:name/top.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		dbConfig, ok := databaseConfig(ps.ByName("name"))
+
+		if !ok {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("unknown database %s", ps.ByName("name")))
+			return
+		}
+
+		sortBy := r.URL.Query().Get("sort")
+
+		if sortBy == "" {
+			sortBy = statements.SortTotalLatency
+		}
+
+		if !statements.ValidSort(sortBy) {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("can't sort statements by %s", sortBy))
+			return
+		}
+
+		limit := 20
+
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+
+			if limit, err = strconv.Atoi(value); err != nil {
+				jsonError(w, http.StatusBadRequest, fmt.Sprintf("limit must be a number, not %q", value))
+				return
+			}
+		}
+
+		interval, ok := statementTracker.Top(dbConfig.Name, sortBy, limit)
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		response := map[string]interface{}{
+			"name":       dbConfig.Name,
+			"sort":       sortBy,
+			"statements": interval.Statements,
+		}
+
+		if interval.Error != "" {
+			response["error"] = interval.Error
+		}
+
+		// Until we have two samples there's nothing to compare
+		if ok && !interval.Since.IsZero() {
+			response["since"] = interval.Since
+			response["until"] = interval.Until
+		}
+
 		jsonResponse, _ := json.Marshal(response)
 
 		fmt.Fprint(w, string(jsonResponse))
 	})
 
+	router.GET("/kills.json", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		name := r.URL.Query().Get("database")
+
+		// Only what happened in the groups they can see
+		events := queryKiller.Events(100, func(event killer.Event) bool {
+			return (name == "" || event.Database == name) && authenticator.Can(r, auth.PermissionView, event.Group)
+		})
+
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		jsonResponse, _ := json.Marshal(events)
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
+	router.GET("/metrics", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// Prometheus text format
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		if err := exporter.Write(w, visible(r, statuses.Snapshot().Statuses)); err != nil {
+			log.Printf("Error writing metrics: %s", err)
+		}
+	})
+
+	router.GET("/history/:name", auth.PermissionView, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		// JSON please
+		w.Header().Set("Content-Type", "application/json")
+
+		name := strings.TrimSuffix(ps.ByName("name"), ".json")
+		metric := r.URL.Query().Get("metric")
+
+		if !metricHistory.Has(name) && metricStorage == nil {
+			jsonError(w, http.StatusNotFound, fmt.Sprintf("unknown database %s", name))
+			return
+		}
+
+		if metric == "" {
+			jsonError(w, http.StatusBadRequest, "metric is required")
+			return
+		}
+
+		since, err := parseTime(r.URL.Query().Get("since"), time.Time{})
+
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		until, err := parseTime(r.URL.Query().Get("until"), time.Now())
+
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		resolution, points, err := historyPoints(name, metric, since, until, r.URL.Query().Get("resolution"))
+
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		jsonResponse, _ := json.Marshal(map[string]interface{}{
+			"name":       name,
+			"metric":     metric,
+			"resolution": resolution,
+			"points":     points,
+		})
+
+		fmt.Fprint(w, string(jsonResponse))
+	})
+
 	// Set the router to use
 	app.UseHandler(router)
 
@@ -75,29 +727,358 @@ func main() {
 	app.Run(":" + os.Getenv("PORT"))
 }
 
-func monitor() (map[string]*database.DatabaseStatus, error) {
-	// Load the config on each request in case it gets updated
-	tsConfig, err := config.Load(os.Getenv("CONFIG_FILE"))
+// Run one of the auth helper commands
+func runCommand(command string) {
+	switch command {
+	case "hash-password":
+		// Read the password from stdin so it doesn't end up in the shell history
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+		if err != nil && password == "" {
+			log.Fatal(err)
+		}
+
+		hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(hash)
+	case "generate-token":
+		token, hash, err := auth.GenerateToken()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Token: %s\nHash:  %s\n", token, hash)
+	default:
+		fmt.Println("Usage: tsadmin [hash-password|generate-token]")
+		os.Exit(1)
+	}
+}
+
+// Who made the request, for the audit log
+func actor(r *http.Request) string {
+	if identity := auth.FromRequest(r); identity != nil {
+		return identity.Name
+	}
+
+	return "anonymous"
+}
+
+// The statuses of the databases the request is allowed to see
+func visible(r *http.Request, all []*database.DatabaseStatus) []*database.DatabaseStatus {
+	allowed := []*database.DatabaseStatus{}
+
+	for _, status := range all {
+		if authenticator.Can(r, auth.PermissionView, status.Metadata.Group) {
+			allowed = append(allowed, status)
+		}
+	}
+
+	return allowed
+}
+
+// The config of the database with the given name
+func databaseConfig(name string) (database.Database, bool) {
+	for _, dbConfig := range currentConfig().Databases {
+		if dbConfig.Name == name {
+			return dbConfig, true
+		}
+	}
+
+	return database.Database{}, false
+}
+
+// The group of the database with the given name
+func groupOf(name string) string {
+	dbConfig, _ := databaseConfig(name)
+
+	return dbConfig.Group
+}
+
+// The group a maintenance window covers
+func windowGroup(window maintenance.Window) string {
+	if window.Group != "" {
+		return window.Group
+	}
+
+	return groupOf(window.Database)
+}
+
+// Whether the request came from a script rather than a form on some other site.
+// Browsers send cached basic auth credentials with cross site form posts but a
+// form can't send JSON or custom headers without the browser asking us first.
+func fromScript(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return mediaType == "application/json" || r.Header.Get("X-Requested-With") != ""
+}
+
+// Respond with an error message as JSON
+func jsonError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	jsonResponse, _ := json.Marshal(map[string]string{"error": message})
+
+	fmt.Fprint(w, string(jsonResponse))
+}
+
+// Store the latest statuses, add them to the history and check them for alerts
+func record(updated map[string]*database.DatabaseStatus) {
+	tsConfig := currentConfig()
+
+	statuses.Update(updated)
+	metricHistory.SetRetention(tsConfig.HistoryRetention.Duration)
+	metricHistory.Add(updated)
+
+	now := time.Now()
+	transitions := alerts.Evaluate(tsConfig.Alerts, statuses.Snapshot().Statuses, now)
+
+	for _, transition := range transitions {
+		log.Printf("Alert %s for %s is now %s (value %g)", transition.Alert.Rule, transition.Alert.Database, transition.To, transition.Alert.Value)
+	}
+
+	// Let people know, this also sends anything that was held back earlier
+	notifier.Notify(tsConfig.Notifications, transitions, now)
+
+	// Persist them too if storage is enabled
+	if metricStorage != nil {
+		metricStorage.SetRetention(storage.Raw, tsConfig.Storage.RawRetention.Duration)
+		metricStorage.SetRetention(storage.Minute, tsConfig.Storage.MinuteRetention.Duration)
+		metricStorage.SetRetention(storage.Hour, tsConfig.Storage.HourRetention.Duration)
+
+		if err := metricStorage.Write(updated); err != nil {
+			log.Printf("Error writing to storage: %s", err)
+		}
+	}
+}
+
+// Apply the kill policies to the databases that are up, this runs alongside the
+// checks and if the last run is still going we skip this one
+func enforcePolicies() {
+	tsConfig := currentConfig()
+
+	if len(tsConfig.KillPolicies) == 0 || !atomic.CompareAndSwapInt32(&killing, 0, 1) {
+		return
+	}
+
+	databases := []database.Database{}
+
+	for _, dbConfig := range tsConfig.Databases {
+		if status := statuses.Latest(dbConfig.Name); status != nil && status.State == database.StateOK {
+			databases = append(databases, dbConfig)
+		}
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&killing, 0)
+		queryKiller.Run(tsConfig.KillPolicies, databases)
+	}()
+}
+
+// Collect the statement digests of the databases that are up, this is a lot more
+// work for the database than the regular checks so it's done less often
+func collectStatements() {
+	tsConfig := currentConfig()
+
+	if time.Since(statementsCollectedAt) < tsConfig.StatementsEvery.Duration || !atomic.CompareAndSwapInt32(&collectingStatements, 0, 1) {
+		return
+	}
+
+	statementsCollectedAt = time.Now()
+	databases := []database.Database{}
+
+	for _, dbConfig := range tsConfig.Databases {
+		if status := statuses.Latest(dbConfig.Name); status != nil && status.State == database.StateOK {
+			databases = append(databases, dbConfig)
+		}
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&collectingStatements, 0)
+		statementTracker.Collect(databases)
+	}()
+}
+
+// Parse a time parameter of a request, this can be a unix timestamp, an RFC3339
+// time or a duration such as 5m meaning that long ago
+func parseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	if timestamp, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(timestamp*1e9)), nil
+	}
+
+	if duration, err := config.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+
+	return time.Time{}, fmt.Errorf("times must be a unix timestamp, an RFC3339 time or a duration, not %q", value)
+}
+
+// Look up the values of a metric between since and until, recent values come from
+// memory and anything older from storage at a resolution that suits the time range.
+// Points are [unix timestamp, value] pairs, or [unix timestamp, avg, min, max] for
+// the 1m and 1h resolutions.
+func historyPoints(name string, metric string, since time.Time, until time.Time, resolution string) (string, [][]float64, error) {
+	points := [][]float64{}
+
+	if resolution == "" {
+		resolution = pickResolution(since, until)
+	}
+
+	if resolution == "memory" {
+		for _, point := range metricHistory.Points(name, metric, since) {
+			if !point.Time.After(until) {
+				points = append(points, []float64{timestamp(point.Time), point.Value})
+			}
+		}
+
+		return resolution, points, nil
+	}
+
+	if metricStorage == nil {
+		return resolution, nil, fmt.Errorf("storage is not enabled")
+	}
+
+	stored, err := metricStorage.Points(resolution, name, metric, since, until)
 
 	if err != nil {
-		log.Fatal(err)
+		return resolution, nil, err
 	}
 
+	for _, point := range stored {
+		if resolution == storage.Raw {
+			points = append(points, []float64{timestamp(point.Time), point.Avg})
+		} else {
+			points = append(points, []float64{timestamp(point.Time), point.Avg, point.Min, point.Max})
+		}
+	}
+
+	return resolution, points, nil
+}
+
+// Pick the best place to read the given time range from, the finest resolution that
+// covers the whole range without returning an unreasonable number of points
+func pickResolution(since time.Time, until time.Time) string {
+	now := time.Now()
+	span := until.Sub(since)
+	tsConfig := currentConfig()
+
+	switch {
+	case metricStorage == nil || !since.Before(now.Add(-tsConfig.HistoryRetention.Duration)):
+		return "memory"
+	case !since.Before(now.Add(-metricStorage.Retention(storage.Raw))) && span <= 6*time.Hour:
+		return storage.Raw
+	case !since.Before(now.Add(-metricStorage.Retention(storage.Minute))) && span <= 7*24*time.Hour:
+		return storage.Minute
+	default:
+		return storage.Hour
+	}
+}
+
+func timestamp(at time.Time) float64 {
+	return float64(at.UnixNano()) / 1e9
+}
+
+// Load the config, if it's broken carry on with the last config that worked
+func loadConfig() {
+	loadedConfig, err := config.Load(os.Getenv("CONFIG_FILE"))
+
+	if err != nil {
+		if err.Error() != configError {
+			log.Printf("Error loading config, using the last known good config: %s", err)
+		}
+
+		configError = err.Error()
+	} else {
+		configMutex.Lock()
+		activeConfig = loadedConfig
+		configMutex.Unlock()
+
+		configError = ""
+	}
+}
+
+// The config that is currently in use
+func currentConfig() config.Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return activeConfig
+}
+
+func monitor() map[string]*database.DatabaseStatus {
+	// Load the config on each request in case it gets updated
+	loadConfig()
+	tsConfig := currentConfig()
+
+	// Close the connections to anything we no longer monitor
+	pool.Retain(tsConfig.Databases)
+	requestPool.Retain(tsConfig.Databases)
+
 	// Define our response map
 	updatedStatuses := make(map[string]*database.DatabaseStatus)
+	mutex := sync.Mutex{}
+
+	// Fan the databases out to a pool of workers
+	jobs := make(chan database.Database)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < tsConfig.Workers && i < len(tsConfig.Databases); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for dbConfig := range jobs {
+				status := fetchStatus(dbConfig)
+
+				mutex.Lock()
+				updatedStatuses[dbConfig.Name] = status
+				mutex.Unlock()
+			}
+		}()
+	}
 
-	// Loop each database and fetch the status
 	for _, dbConfig := range tsConfig.Databases {
-		// Get the database status, here we pass the last known status
-		// so we can determine metrics like queries per second
-		status, err := database.Status(dbConfig, statuses[dbConfig.Name])
+		jobs <- dbConfig
+	}
 
-		if err != nil {
-			log.Fatal(err)
-		}
+	close(jobs)
+	wg.Wait()
+
+	return updatedStatuses
+}
+
+// Fetch the status of a single database, giving up after the timeout
+func fetchStatus(dbConfig database.Database) *database.DatabaseStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), dbConfig.Timeout)
+	defer cancel()
+
+	// Get the database status, here we pass the last known status
+	// so we can determine metrics like queries per second
+	previous := statuses.Latest(dbConfig.Name)
+	status, _ := database.Status(ctx, pool, dbConfig, previous)
+	status.Maintenance = schedule.Active(dbConfig.Name, dbConfig.Group, time.Now()) != nil
 
-		updatedStatuses[dbConfig.Name] = status
+	// Only log changes in state so a host being down doesn't flood the logs
+	if status.State != database.StateOK && (previous == nil || previous.State == database.StateOK) {
+		log.Printf("Error fetching status of %s (%s): %s", dbConfig.Name, status.State, status.Error)
+	} else if status.State == database.StateOK && previous != nil && previous.State != database.StateOK {
+		log.Printf("%s has recovered after %d failures", dbConfig.Name, previous.ConsecutiveFailures)
 	}
 
-	return updatedStatuses, nil
+	return status
 }